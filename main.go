@@ -1,370 +1,229 @@
+// Command aws-s3-uploader uploads a local directory to an S3 bucket.
+// The upload logic lives in the importable pkg/uploader package.
 package main
 
 import (
+	"cmp"
 	"context"
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
-	"path/filepath"
-	"runtime"
+	"os/signal"
 	"strings"
-	"sync"
-	"time"
+	"syscall"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/aws/smithy-go"
-	"github.com/cheggaaa/pb/v3"
-	"go.uber.org/zap"
-	"go.uber.org/zap/zapcore"
+	"github.com/bimat0206/aws-s3-uploader/pkg/uploader"
 )
 
-// Config holds the configuration for the S3 uploader
-type Config struct {
-	// AWS Configuration
-	AWSProfile string `json:"aws_profile"`
-	AccessKey  string `json:"access_key"`
-	SecretKey  string `json:"secret_key"`
-	Region     string `json:"region"`
-	
-	// S3 Configuration
-	BucketName string `json:"bucket_name"`
-	S3Prefix   string `json:"s3_prefix"`
-	
-	// Local Configuration
-	LocalPath  string `json:"local_path"`
-	
-	// Optional Configuration
-	Pattern        string `json:"pattern,omitempty"`
-	MaxConcurrency int    `json:"max_concurrency,omitempty"`
-	LogLevel       string `json:"log_level,omitempty"`
-}
-
-// Uploader handles the S3 upload process
-type Uploader struct {
-	s3Client *s3.Client
-	config   *Config
-	logger   *zap.Logger
-}
-
-// LoadConfig loads configuration from a JSON file
-func LoadConfig(configPath string) (*Config, error) {
-	// Open the config file
-	file, err := os.Open(configPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open config file: %w", err)
-	}
-	defer file.Close()
+// configPaths collects repeated --config flags in the order they were given
+type configPaths []string
 
-	// Decode the JSON file into the Config struct
-	var config Config
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&config); err != nil {
-		return nil, fmt.Errorf("failed to parse config file: %w", err)
-	}
-
-	// Set default values for optional fields
-	if config.Pattern == "" {
-		config.Pattern = "*" // Match all files by default
-	}
-	
-	if config.MaxConcurrency <= 0 {
-		config.MaxConcurrency = runtime.NumCPU() * 2
-	}
-	
-	if config.LogLevel == "" {
-		config.LogLevel = "info"
-	}
+func (p *configPaths) String() string { return strings.Join(*p, ", ") }
 
-	return &config, nil
+func (p *configPaths) Set(value string) error {
+	*p = append(*p, value)
+	return nil
 }
 
-// NewUploader creates a new S3 uploader with validation
-func NewUploader(cfg *Config) (*Uploader, error) {
-	// Validate required fields
-	if cfg.BucketName == "" {
-		return nil, errors.New("bucket_name is required in config")
-	}
-	
-	if cfg.LocalPath == "" {
-		return nil, errors.New("local_path is required in config")
-	}
-	
-	// Verify source directory exists
-	if _, err := os.Stat(cfg.LocalPath); os.IsNotExist(err) {
-		return nil, fmt.Errorf("local_path directory does not exist: %s", cfg.LocalPath)
-	}
-	
-	// Ensure region is set
-	if cfg.Region == "" {
-		cfg.Region = "us-east-1" // Default region
-	}
-
-	// Configure AWS SDK options
-	var awsConfigOptions []func(*config.LoadOptions) error
-	
-	// Set region
-	awsConfigOptions = append(awsConfigOptions, config.WithRegion(cfg.Region))
+func main() {
+	// Define command line flag for config file paths; later files override earlier ones
+	var configs configPaths
+	flag.Var(&configs, "config", "Path to a JSON or YAML config file; repeat to layer files, later ones overriding earlier ones (default config.json)")
+	dryRun := flag.Bool("dry-run", false, "Show what would be uploaded without uploading")
+	mirror := flag.Bool("delete", false, "Delete objects under the prefix that no longer exist locally")
+	validateOnly := flag.Bool("validate-only", false, "Check the configuration and exit without uploading")
+	list := flag.Bool("list", false, "Print the files that would be uploaded and their sizes, then exit without contacting S3")
+	mode := flag.String("mode", "", "upload, download to restore the prefix into local_path, or move to copy move_source_prefix to the prefix (overrides mode)")
+
+	// Overrides for config file values; only flags given on the command line are applied
+	bucket := flag.String("bucket", "", "S3 bucket name (overrides bucket_name)")
+	prefix := flag.String("prefix", "", "S3 key prefix (overrides s3_prefix)")
+	localPath := flag.String("local-path", "", "Local directory to upload (overrides local_path)")
+	fileList := flag.String("file-list", "", "File listing the paths to upload, or - for stdin (overrides file_list)")
+	region := flag.String("region", "", "AWS region (overrides region)")
+	concurrency := flag.Int("concurrency", 0, "Number of concurrent uploads (overrides max_concurrency)")
+	logLevel := flag.String("log-level", "", "Log level: debug, info, warn or error (overrides log_level)")
+	quiet := flag.Bool("quiet", false, "Only log errors and hide the progress bar")
+	verbose := flag.Bool("verbose", false, "Log debug messages, including the time taken by each file")
+	noProgress := flag.Bool("no-progress", false, "Log progress periodically instead of drawing a progress bar")
+	flag.Parse()
 
-	// Set credentials if provided
-	if cfg.AccessKey != "" && cfg.SecretKey != "" {
-		staticProvider := credentials.NewStaticCredentialsProvider(cfg.AccessKey, cfg.SecretKey, "")
-		awsConfigOptions = append(awsConfigOptions, config.WithCredentialsProvider(staticProvider))
-	} else if cfg.AWSProfile != "" {
-		// Use named profile if specified
-		awsConfigOptions = append(awsConfigOptions, config.WithSharedConfigProfile(cfg.AWSProfile))
-	}
-	
-	// Load AWS configuration
-	awsConfig, err := config.LoadDefaultConfig(context.TODO(), awsConfigOptions...)
-	if err != nil {
-		return nil, fmt.Errorf("failed to load AWS configuration: %w", err)
+	if *quiet && *verbose {
+		exit(uploader.ExitConfig, "--quiet and --verbose cannot be used together")
 	}
 
-	// Create S3 client
-	s3Options := []func(*s3.Options){
-		func(o *s3.Options) {
-			o.UsePathStyle = true
-		},
+	if len(configs) == 0 {
+		configs = configPaths{"config.json"}
 	}
-	s3Client := s3.NewFromConfig(awsConfig, s3Options...)
-	
-	// Create logger
-	logger, err := createLogger(cfg.LogLevel)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create logger: %w", err)
-	}
-
-	return &Uploader{
-		s3Client: s3Client,
-		config:   cfg,
-		logger:   logger,
-	}, nil
-}
 
-// Upload starts the upload process
-func (u *Uploader) Upload() error {
-	// Create a context with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 24*time.Hour)
-	defer cancel()
-
-	u.logger.Info("Starting upload",
-		zap.String("source", u.config.LocalPath),
-		zap.String("bucket", u.config.BucketName),
-		zap.String("prefix", u.config.S3Prefix),
-		zap.String("region", u.config.Region))
-
-	// Find files to upload
-	files, err := u.findFiles()
+	// Load configuration from the config files
+	config, err := uploader.LoadConfig(configs...)
 	if err != nil {
-		return fmt.Errorf("failed to find files: %w", err)
-	}
+		exit(uploader.ExitConfig, "Failed to load configuration: %v", err)
+	}
+
+	if *dryRun {
+		config.DryRun = true
+	}
+	if *mirror {
+		config.Mirror = true
+	}
+
+	// Flags that were set explicitly win over the config file
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "bucket":
+			config.BucketName = *bucket
+		case "prefix":
+			config.S3Prefix = *prefix
+		case "local-path":
+			config.LocalPath = *localPath
+		case "file-list":
+			config.FileList = *fileList
+		case "region":
+			config.Region = *region
+		case "concurrency":
+			config.MaxConcurrency = *concurrency
+		case "log-level":
+			config.LogLevel = *logLevel
+		case "mode":
+			config.Mode = *mode
+		}
+	})
 
-	if len(files) == 0 {
-		u.logger.Info("No files to upload")
-		return nil
+	if *noProgress {
+		config.NoProgress = true
 	}
 
-	u.logger.Info("Found files to upload", zap.Int("count", len(files)))
-
-	// Create progress bar
-	bar := pb.Full.Start(len(files))
-
-	// Create worker pool
-	var wg sync.WaitGroup
-	jobs := make(chan string, len(files))
-	results := make(chan error, len(files))
-	
-	// Start workers
-	for i := 0; i < u.config.MaxConcurrency; i++ {
-		wg.Add(1)
-		go u.uploadWorker(ctx, &wg, jobs, results, bar)
+	// --quiet and --verbose win over log_level from either the file or --log-level
+	if *quiet {
+		config.LogLevel = "error"
+		config.NoProgress = true
 	}
-
-	// Send jobs
-	for _, file := range files {
-		jobs <- file
+	if *verbose {
+		config.LogLevel = "debug"
 	}
-	close(jobs)
-
-	// Wait for workers to finish
-	wg.Wait()
-	close(results)
 
-	// Process results
-	var failedFiles int
-	for err := range results {
-		if err != nil {
-			failedFiles++
+	if *validateOnly {
+		if err := config.Validate(); err != nil {
+			exit(uploader.ExitConfig, "Invalid configuration: %v", err)
 		}
+		fmt.Printf("Configuration in %s is valid\n", configs.String())
+		return
 	}
 
-	bar.Finish()
-
-	if failedFiles > 0 {
-		u.logger.Warn("Upload completed with errors", zap.Int("failed_files", failedFiles))
-		return fmt.Errorf("failed to upload %d files", failedFiles)
+	if *list {
+		listFiles(config)
+		return
 	}
 
-	u.logger.Info("Upload completed successfully", zap.Int("total_files", len(files)))
-	return nil
-}
-
-// findFiles finds all files matching the pattern
-func (u *Uploader) findFiles() ([]string, error) {
-	var files []string
-
-	err := filepath.Walk(u.config.LocalPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		if info.IsDir() {
-			return nil
-		}
-
-		matched, err := filepath.Match(u.config.Pattern, filepath.Base(path))
-		if err != nil {
-			return err
-		}
-
-		if matched {
-			files = append(files, path)
-		}
-
-		return nil
-	})
+	// Print configuration summary
+	if !*quiet {
+		printSummary(configs.String(), config)
+	}
 
+	// Create uploader
+	s3Uploader, err := uploader.NewUploader(config)
 	if err != nil {
-		return nil, err
+		exit(uploader.ExitCode(err), "Failed to create uploader: %v", err)
+	}
+
+	// Cancel the upload on Ctrl-C or SIGTERM so in-flight transfers stop cleanly
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		// Restore default handling so a second signal exits immediately
+		stop()
+	}()
+
+	// Serve metrics for the whole run; the server goes away when the process exits
+	if config.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", s3Uploader.MetricsHandler())
+		go func() {
+			if err := http.ListenAndServe(config.MetricsAddr, mux); err != nil {
+				log.Printf("Metrics server stopped: %v", err)
+			}
+		}()
 	}
 
-	return files, nil
-}
-
-// uploadWorker handles file uploads
-func (u *Uploader) uploadWorker(ctx context.Context, wg *sync.WaitGroup, jobs <-chan string, results chan<- error, bar *pb.ProgressBar) {
-	defer wg.Done()
-
-	for filePath := range jobs {
-		start := time.Now()
-		err := u.uploadFile(ctx, filePath)
-		duration := time.Since(start)
-
-		if err != nil {
-			u.logger.Error("Upload failed",
-				zap.String("file", filePath),
-				zap.Error(err))
-			results <- err
-		} else {
-			// Determine S3 key for logging
-			relPath, _ := filepath.Rel(u.config.LocalPath, filePath)
-			s3Key := filepath.Join(u.config.S3Prefix, filepath.ToSlash(relPath))
-			
-			u.logger.Debug("File uploaded",
-				zap.String("file", filePath),
-				zap.String("s3_key", s3Key),
-				zap.Duration("duration", duration))
-			results <- nil
+	// Start upload
+	if err := s3Uploader.UploadWithContext(ctx); err != nil {
+		// List each failed file so it can be retried on its own
+		var uploadErr *uploader.UploadError
+		if errors.As(err, &uploadErr) {
+			for _, failure := range uploadErr.Failures {
+				fmt.Fprintf(os.Stderr, "  %v\n", failure)
+			}
 		}
-
-		bar.Increment()
+		exit(uploader.ExitCode(err), "Upload failed: %v", err)
 	}
 }
 
-// uploadFile uploads a single file to S3
-func (u *Uploader) uploadFile(ctx context.Context, filePath string) error {
-	// Open the file
-	file, err := os.Open(filePath)
+// listFiles prints the size and path of every file config selects, followed by the totals
+func listFiles(config *uploader.Config) {
+	files, err := config.ListFiles()
 	if err != nil {
-		return fmt.Errorf("failed to open file: %w", err)
+		exit(uploader.ExitCode(err), "Failed to list files: %v", err)
 	}
-	defer file.Close()
-	
-	// Determine S3 key
-	relPath, err := filepath.Rel(u.config.LocalPath, filePath)
-	if err != nil {
-		return fmt.Errorf("failed to determine relative path: %w", err)
-	}
-	s3Key := filepath.Join(u.config.S3Prefix, filepath.ToSlash(relPath))
-	
-	// Upload to S3
-	_, err = u.s3Client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket: aws.String(u.config.BucketName),
-		Key:    aws.String(s3Key),
-		Body:   file,
-	})
-	
-	if err != nil {
-		var apiErr smithy.APIError
-		if errors.As(err, &apiErr) {
-			if strings.Contains(apiErr.Error(), "region") {
-				u.logger.Error("Region error detected",
-					zap.String("file", filePath),
-					zap.String("s3_key", s3Key),
-					zap.Error(err))
-			}
+	var total int64
+	for _, file := range files {
+		if file.Dir {
+			fmt.Printf("%12s  %s%c\n", "-", file.Path, os.PathSeparator)
+			continue
 		}
-		return fmt.Errorf("failed to upload file: %w", err)
+		fmt.Printf("%12d  %s\n", file.Size, file.Path)
+		total += file.Size
 	}
-	
-	return nil
+	fmt.Printf("%d files, %d bytes\n", len(files), total)
 }
 
-// createLogger creates a new logger with the specified log level
-func createLogger(level string) (*zap.Logger, error) {
-	// Logger configuration
-	config := zap.NewProductionConfig()
-	
-	// Set log level
-	switch strings.ToLower(level) {
-	case "debug":
-		config.Level = zap.NewAtomicLevelAt(zapcore.DebugLevel)
-	case "info":
-		config.Level = zap.NewAtomicLevelAt(zapcore.InfoLevel)
-	case "warn":
-		config.Level = zap.NewAtomicLevelAt(zapcore.WarnLevel)
-	case "error":
-		config.Level = zap.NewAtomicLevelAt(zapcore.ErrorLevel)
-	default:
-		config.Level = zap.NewAtomicLevelAt(zapcore.InfoLevel)
-	}
-	
-	return config.Build()
+// exit logs a message and ends the process with code, one of the uploader.Exit constants
+func exit(code int, format string, args ...any) {
+	log.Printf(format, args...)
+	os.Exit(code)
 }
 
-func main() {
-	// Define command line flag for config file path
-	configPath := flag.String("config", "config.json", "Path to config.json file")
-	flag.Parse()
-	
-	// Load configuration from JSON file
-	config, err := LoadConfig(*configPath)
-	if err != nil {
-		log.Fatalf("Failed to load configuration: %v", err)
-	}
-	
-	// Print configuration summary
-	fmt.Printf("Configuration loaded from %s:\n", *configPath)
+// printSummary prints the settings the upload will run with
+func printSummary(configPath string, config *uploader.Config) {
+	fmt.Printf("Configuration loaded from %s:\n", configPath)
 	fmt.Printf("  Bucket: %s\n", config.BucketName)
 	fmt.Printf("  Prefix: %s\n", config.S3Prefix)
 	fmt.Printf("  Region: %s\n", config.Region)
-	fmt.Printf("  Source: %s\n", config.LocalPath)
-	fmt.Printf("  Pattern: %s\n", config.Pattern)
-	
-	// Create uploader
-	uploader, err := NewUploader(config)
-	if err != nil {
-		log.Fatalf("Failed to create uploader: %v", err)
+	for _, target := range config.Buckets {
+		fmt.Printf("  Also to: %s (region %s, prefix %s)\n", target.BucketName, cmp.Or(target.Region, config.Region), cmp.Or(target.S3Prefix, config.S3Prefix))
 	}
-	
-	// Start upload
-	if err := uploader.Upload(); err != nil {
-		log.Fatalf("Upload failed: %v", err)
+	for _, source := range config.AllSources() {
+		if source.S3Prefix != "" {
+			fmt.Printf("  Source: %s -> %s\n", source.LocalPath, source.S3Prefix)
+		} else {
+			fmt.Printf("  Source: %s\n", source.LocalPath)
+		}
+	}
+	fmt.Printf("  Patterns: %s\n", strings.Join(config.IncludePatterns(), ", "))
+	switch config.Mode {
+	case uploader.ModeDownload:
+		fmt.Println("  Mode: download objects under the prefix into the local path")
+	case uploader.ModeMove:
+		fmt.Printf("  Mode: move objects from %s to the prefix\n", config.MoveSourcePrefix)
+		if config.DeleteSource {
+			fmt.Println("  Delete source: objects are deleted from the source prefix once copied")
+		}
+	}
+	if config.DryRun {
+		fmt.Println("  Dry run: no files will be uploaded")
+	}
+	if config.Mirror {
+		fmt.Println("  Mirror: stale objects under the prefix will be deleted")
+	}
+	if config.NoOverwrite {
+		fmt.Println("  No overwrite: existing objects are never replaced")
+	}
+	if config.InsecureSkipVerify {
+		fmt.Println("  WARNING: TLS certificate verification is disabled (insecure_skip_verify)")
 	}
 }
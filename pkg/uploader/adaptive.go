@@ -0,0 +1,112 @@
+package uploader
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// adaptiveInitialWorkers is how many uploads run at once when adaptive concurrency starts
+	adaptiveInitialWorkers = 2
+	// adaptiveInterval is how often the worker count is re-evaluated
+	adaptiveInterval = 5 * time.Second
+)
+
+// concurrencyGate limits how many workers upload at the same time. The limit can
+// change while workers are running.
+type concurrencyGate struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	limit  int
+	active int
+	closed bool
+}
+
+func newConcurrencyGate(limit int) *concurrencyGate {
+	g := &concurrencyGate{limit: limit}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// acquire blocks until a slot is free. It returns false once the gate is closed.
+func (g *concurrencyGate) acquire() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for !g.closed && g.active >= g.limit {
+		g.cond.Wait()
+	}
+	if g.closed {
+		return false
+	}
+	g.active++
+	return true
+}
+
+func (g *concurrencyGate) release() {
+	g.mu.Lock()
+	g.active--
+	g.mu.Unlock()
+	g.cond.Broadcast()
+}
+
+func (g *concurrencyGate) setLimit(limit int) {
+	g.mu.Lock()
+	g.limit = limit
+	g.mu.Unlock()
+	g.cond.Broadcast()
+}
+
+// close wakes every waiting worker and makes acquire fail from now on
+func (g *concurrencyGate) close() {
+	g.mu.Lock()
+	g.closed = true
+	g.mu.Unlock()
+	g.cond.Broadcast()
+}
+
+// tuneConcurrency adjusts the gate's limit until done is closed. Concurrency grows by
+// one worker while throughput keeps improving and is halved when S3 starts throttling.
+func (u *Uploader) tuneConcurrency(ctx context.Context, gate *concurrencyGate, limit int, done <-chan struct{}) {
+	ticker := time.NewTicker(adaptiveInterval)
+	defer ticker.Stop()
+
+	var lastBytes, lastThrottles int64
+	var lastRate float64
+	for {
+		select {
+		case <-ctx.Done():
+			gate.close()
+			return
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		bytes := atomic.LoadInt64(&u.bytesUploaded)
+		rate := float64(bytes-lastBytes) / adaptiveInterval.Seconds()
+		throttles := atomic.LoadInt64(&u.throttleEvents)
+
+		newLimit := limit
+		switch {
+		case throttles > lastThrottles:
+			newLimit = max(1, limit/2)
+		case rate > lastRate*1.05 && limit < u.config.MaxConcurrency:
+			newLimit = limit + 1
+		}
+		lastBytes, lastThrottles, lastRate = bytes, throttles, rate
+
+		if newLimit != limit {
+			u.logger.Info("Adjusting concurrency",
+				zap.Int("from", limit),
+				zap.Int("to", newLimit),
+				zap.Float64("throughput_mb_per_sec", rate/(1024*1024)),
+				zap.Bool("throttled", newLimit < limit))
+			gate.setLimit(newLimit)
+			limit = newLimit
+		}
+	}
+}
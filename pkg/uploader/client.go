@@ -0,0 +1,402 @@
+package uploader
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
+	"go.uber.org/zap"
+)
+
+// S3API is the subset of the S3 client used by Uploader. *s3.Client implements it;
+// tests can supply their own implementation through NewUploaderWithClient.
+type S3API interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error)
+	CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error)
+}
+
+// newS3Client creates an S3 client from the AWS settings in cfg
+func newS3Client(cfg *Config) (*s3.Client, error) {
+	// Configure AWS SDK options
+	var awsConfigOptions []func(*config.LoadOptions) error
+
+	// Set region
+	awsConfigOptions = append(awsConfigOptions, config.WithRegion(cfg.Region))
+
+	// Set credentials if provided
+	if cfg.AccessKey != "" && cfg.SecretKey != "" {
+		staticProvider := credentials.NewStaticCredentialsProvider(cfg.AccessKey, cfg.SecretKey, cfg.SessionToken)
+		awsConfigOptions = append(awsConfigOptions, config.WithCredentialsProvider(staticProvider))
+	} else if cfg.AWSProfile != "" {
+		// Use named profile if specified
+		awsConfigOptions = append(awsConfigOptions, config.WithSharedConfigProfile(cfg.AWSProfile))
+	}
+
+	// Tune the SDK's own retryer, which runs inside each attempt of withRetry
+	if cfg.SDKMaxAttempts > 0 || cfg.SDKMaxBackoff != "" {
+		maxBackoff, err := parseDuration("sdk_max_backoff", cfg.SDKMaxBackoff, 0)
+		if err != nil {
+			return nil, err
+		}
+		awsConfigOptions = append(awsConfigOptions, config.WithRetryer(func() aws.Retryer {
+			return retry.NewStandard(func(o *retry.StandardOptions) {
+				if cfg.SDKMaxAttempts > 0 {
+					o.MaxAttempts = cfg.SDKMaxAttempts
+				}
+				if maxBackoff > 0 {
+					o.MaxBackoff = maxBackoff
+				}
+			})
+		}))
+	}
+
+	httpClient, err := newHTTPClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	awsConfigOptions = append(awsConfigOptions, config.WithHTTPClient(httpClient))
+
+	// Load AWS configuration
+	awsConfig, err := config.LoadDefaultConfig(context.TODO(), awsConfigOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS configuration: %w", err)
+	}
+
+	// Assume the role using the credentials loaded above; the cache refreshes them before they expire
+	if cfg.AssumeRoleARN != "" {
+		sessionName := cfg.SessionName
+		if sessionName == "" {
+			sessionName = defaultSessionName
+		}
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(awsConfig), cfg.AssumeRoleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = sessionName
+			if cfg.ExternalID != "" {
+				o.ExternalID = aws.String(cfg.ExternalID)
+			}
+		})
+		awsConfig.Credentials = aws.NewCredentialsCache(provider)
+	}
+
+	// Create S3 client
+	s3Options := []func(*s3.Options){
+		func(o *s3.Options) {
+			o.UsePathStyle = cfg.UsePathStyle
+			if cfg.Endpoint != "" {
+				o.BaseEndpoint = aws.String(cfg.Endpoint)
+			}
+			if cfg.UseDualStack {
+				o.EndpointOptions.UseDualStackEndpoint = aws.DualStackEndpointStateEnabled
+			}
+			if cfg.UseFIPS {
+				o.EndpointOptions.UseFIPSEndpoint = aws.FIPSEndpointStateEnabled
+			}
+			o.UseAccelerate = cfg.UseAccelerate
+		},
+	}
+	return s3.NewFromConfig(awsConfig, s3Options...), nil
+}
+
+// newHTTPClient creates the SDK's HTTP client with the proxy, TLS and connection pool
+// settings from cfg. The transport otherwise keeps the SDK defaults, including proxies
+// from the environment.
+func newHTTPClient(cfg *Config) (*awshttp.BuildableClient, error) {
+	var proxy *url.URL
+	if cfg.HTTPProxy != "" {
+		var err error
+		if proxy, err = url.Parse(cfg.HTTPProxy); err != nil {
+			return nil, fmt.Errorf("invalid http_proxy: %w", err)
+		}
+	}
+
+	var roots *x509.CertPool
+	if cfg.CACertFile != "" {
+		var err error
+		if roots, err = loadCACerts(cfg.CACertFile); err != nil {
+			return nil, err
+		}
+	}
+
+	idleTimeout, err := parseDuration("idle_conn_timeout", cfg.IdleConnTimeout, defaultIdleConnTimeout)
+	if err != nil {
+		return nil, err
+	}
+	// Each worker can have PartConcurrency requests in flight, all to the same host
+	perHost := cfg.MaxIdleConnsPerHost
+	if perHost == 0 {
+		perHost = max(cfg.MaxConcurrency*cfg.PartConcurrency, defaultMaxIdleConnsPerHost)
+	}
+	total := cfg.MaxIdleConns
+	if total == 0 {
+		total = defaultMaxIdleConns
+	}
+
+	return awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+		tr.MaxIdleConnsPerHost = perHost
+		tr.MaxIdleConns = max(total, perHost)
+		tr.IdleConnTimeout = idleTimeout
+		if proxy != nil {
+			tr.Proxy = http.ProxyURL(proxy)
+		}
+		if tr.TLSClientConfig == nil {
+			tr.TLSClientConfig = &tls.Config{}
+		}
+		if roots != nil {
+			tr.TLSClientConfig.RootCAs = roots
+		}
+		tr.TLSClientConfig.InsecureSkipVerify = cfg.InsecureSkipVerify
+	}), nil
+}
+
+// loadCACerts returns the system roots plus the PEM certificates in path
+func loadCACerts(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA certificates: %w", err)
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		// Not available on every platform; trust only the given certificates there
+		roots = x509.NewCertPool()
+	}
+	if !roots.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates found in %s", path)
+	}
+	return roots, nil
+}
+
+// checkBucket makes a single HeadBucket call so a wrong bucket name, region or
+// missing permission is reported before any files are walked. With AutoDetectRegion
+// the client is switched to the bucket's region instead of failing.
+func (u *Uploader) checkBucket(ctx context.Context) error {
+	if err := u.requests.wait(ctx); err != nil {
+		return err
+	}
+	out, err := u.client().HeadBucket(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(u.config.BucketName),
+	})
+	if err == nil {
+		if region := aws.ToString(out.BucketRegion); u.config.AutoDetectRegion && region != "" && region != u.config.Region {
+			u.switchRegion(region)
+		}
+		return nil
+	}
+
+	if region := bucketRegion(err); region != "" && region != u.config.Region {
+		if u.config.AutoDetectRegion {
+			u.switchRegion(region)
+			return u.checkBucket(ctx)
+		}
+		return u.wrongRegionError(region, err)
+	}
+
+	var respErr *awshttp.ResponseError
+	if !errors.As(err, &respErr) {
+		return fmt.Errorf("failed to reach bucket %q: %w", u.config.BucketName, err)
+	}
+
+	switch respErr.HTTPStatusCode() {
+	case http.StatusNotFound:
+		return fmt.Errorf("bucket %q does not exist: %w", u.config.BucketName, err)
+	case http.StatusForbidden:
+		return fmt.Errorf("access denied to bucket %q; check the credentials and bucket policy: %w", u.config.BucketName, err)
+	}
+	return fmt.Errorf("failed to reach bucket %q: %w", u.config.BucketName, err)
+}
+
+// client returns the current S3 client
+func (u *Uploader) client() S3API {
+	u.clientMu.RLock()
+	defer u.clientMu.RUnlock()
+	return u.s3Client
+}
+
+// regionErrorCodes are the S3 error codes for a request sent to the wrong region
+var regionErrorCodes = map[string]bool{
+	"PermanentRedirect":                  true,
+	"AuthorizationHeaderMalformed":       true,
+	"IllegalLocationConstraintException": true,
+}
+
+// expectedRegionPattern extracts the region from messages such as
+// "the region 'us-east-1' is wrong; expecting 'eu-west-1'"
+var expectedRegionPattern = regexp.MustCompile(`expecting '([a-z0-9-]+)'`)
+
+// bucketRegion returns the bucket's actual region if err says the request went to the
+// wrong one, or "" otherwise. S3 reports it in the x-amz-bucket-region header on
+// redirects and region mismatches, and in the message of some errors.
+func bucketRegion(err error) string {
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) && respErr.Response != nil {
+		if region := respErr.Response.Header.Get("X-Amz-Bucket-Region"); region != "" {
+			return region
+		}
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && regionErrorCodes[apiErr.ErrorCode()] {
+		if match := expectedRegionPattern.FindStringSubmatch(apiErr.ErrorMessage()); match != nil {
+			return match[1]
+		}
+	}
+	return ""
+}
+
+// wrongRegionError explains how to fix a request that went to the wrong region
+func (u *Uploader) wrongRegionError(region string, err error) error {
+	return fmt.Errorf("bucket %q is in region %q, not %q; set \"region\": %q or \"auto_detect_region\": true in the config: %w",
+		u.config.BucketName, region, u.config.Region, region, err)
+}
+
+// correctRegion handles an upload that failed because the bucket is in another region.
+// The client is switched to that region, once per run, and it returns nil so the caller
+// retries; a second redirect returns an error naming the region. It returns err
+// unchanged if err is not about the region, or names the region already in use.
+func (u *Uploader) correctRegion(err error) error {
+	region := bucketRegion(err)
+	if region == "" {
+		return err
+	}
+
+	// The switch happens under the lock, so a worker that gets the same redirect
+	// meanwhile already sees the new region
+	u.clientMu.Lock()
+	current, corrected := u.config.Region, u.regionCorrected
+	if region != current && !corrected {
+		u.regionCorrected = true
+		u.switchRegionLocked(region)
+	}
+	u.clientMu.Unlock()
+
+	switch {
+	case region == current && corrected:
+		// Another worker has switched already; this request just used the old client
+		return nil
+	case region == current:
+		// Switching to the same region wouldn't change anything
+		return err
+	case corrected:
+		return u.wrongRegionError(region, err)
+	}
+
+	u.logger.Warn("Upload was sent to the wrong region; switching and retrying",
+		zap.String("bucket", u.config.BucketName),
+		zap.String("from_region", current),
+		zap.String("to_region", region))
+	return nil
+}
+
+// requestPayer returns the RequestPayer value for every object request
+func (u *Uploader) requestPayer() types.RequestPayer {
+	if u.config.RequestPayer {
+		return types.RequestPayerRequester
+	}
+	return ""
+}
+
+// accelerateChecker is implemented by *s3.Client. It isn't part of S3API so injected
+// clients don't have to implement it.
+type accelerateChecker interface {
+	GetBucketAccelerateConfiguration(ctx context.Context, params *s3.GetBucketAccelerateConfigurationInput, optFns ...func(*s3.Options)) (*s3.GetBucketAccelerateConfigurationOutput, error)
+}
+
+// checkAccelerate warns if UseAccelerate is set but Transfer Acceleration isn't enabled
+// on the bucket, in which case every upload would fail
+func (u *Uploader) checkAccelerate(ctx context.Context) {
+	checker, ok := u.client().(accelerateChecker)
+	if !ok || u.requests.wait(ctx) != nil {
+		return
+	}
+	out, err := checker.GetBucketAccelerateConfiguration(ctx, &s3.GetBucketAccelerateConfigurationInput{
+		Bucket: aws.String(u.config.BucketName),
+	})
+	if err != nil {
+		u.logger.Warn("Could not check whether Transfer Acceleration is enabled on the bucket",
+			zap.String("bucket", u.config.BucketName),
+			zap.Error(err))
+		return
+	}
+	if out.Status != types.BucketAccelerateStatusEnabled {
+		u.logger.Warn("use_accelerate is set but Transfer Acceleration is not enabled on the bucket; uploads will fail until it is",
+			zap.String("bucket", u.config.BucketName),
+			zap.String("status", string(out.Status)))
+	}
+}
+
+// objectLockChecker is implemented by *s3.Client. It isn't part of S3API so injected
+// clients don't have to implement it.
+type objectLockChecker interface {
+	GetObjectLockConfiguration(ctx context.Context, params *s3.GetObjectLockConfigurationInput, optFns ...func(*s3.Options)) (*s3.GetObjectLockConfigurationOutput, error)
+}
+
+// checkObjectLock warns if ObjectLockMode is set but the bucket doesn't have Object Lock
+// enabled, in which case S3 rejects every upload
+func (u *Uploader) checkObjectLock(ctx context.Context) {
+	checker, ok := u.client().(objectLockChecker)
+	if !ok || u.requests.wait(ctx) != nil {
+		return
+	}
+	out, err := checker.GetObjectLockConfiguration(ctx, &s3.GetObjectLockConfigurationInput{
+		Bucket: aws.String(u.config.BucketName),
+	})
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "ObjectLockConfigurationNotFoundError" {
+		u.logger.Warn("object_lock_mode is set but Object Lock is not enabled on the bucket; uploads will fail",
+			zap.String("bucket", u.config.BucketName))
+		return
+	}
+	if err != nil {
+		u.logger.Warn("Could not check whether Object Lock is enabled on the bucket",
+			zap.String("bucket", u.config.BucketName),
+			zap.Error(err))
+		return
+	}
+	if out.ObjectLockConfiguration == nil || out.ObjectLockConfiguration.ObjectLockEnabled != types.ObjectLockEnabledEnabled {
+		u.logger.Warn("object_lock_mode is set but Object Lock is not enabled on the bucket; uploads will fail",
+			zap.String("bucket", u.config.BucketName))
+	}
+}
+
+// switchRegion points the uploader at region. A client built by NewUploader is
+// recreated with the same options; an injected client is left as is.
+func (u *Uploader) switchRegion(region string) {
+	u.clientMu.Lock()
+	defer u.clientMu.Unlock()
+	u.logger.Info("Detected bucket region",
+		zap.String("bucket", u.config.BucketName),
+		zap.String("configured_region", u.config.Region),
+		zap.String("bucket_region", region))
+	u.switchRegionLocked(region)
+}
+
+// switchRegionLocked is switchRegion for callers that hold clientMu
+func (u *Uploader) switchRegionLocked(region string) {
+	u.config.Region = region
+	if client, ok := u.s3Client.(*s3.Client); ok {
+		u.setClientLocked(s3.New(client.Options(), func(o *s3.Options) {
+			o.Region = region
+		}))
+	}
+}
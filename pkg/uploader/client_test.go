@@ -0,0 +1,99 @@
+package uploader
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/aws/smithy-go"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// redirectError is the error S3 returns for a request sent to the wrong region
+func redirectError(region string) error {
+	return &smithy.GenericAPIError{
+		Code:    "PermanentRedirect",
+		Message: "the region 'us-east-1' is wrong; expecting '" + region + "'",
+	}
+}
+
+func TestCorrectRegionSwitchesOnRedirect(t *testing.T) {
+	// auto_detect_region only changes the check at startup; redirects are always followed
+	u, _ := newTestUploader(t, t.TempDir(), nil)
+
+	if err := u.correctRegion(redirectError("eu-west-1")); err != nil {
+		t.Fatalf("correctRegion returned %v, want nil so the upload is retried", err)
+	}
+	if u.config.Region != "eu-west-1" {
+		t.Errorf("region is %q after the redirect, want eu-west-1", u.config.Region)
+	}
+
+	// Workers that used the old client retry as well
+	if err := u.correctRegion(redirectError("eu-west-1")); err != nil {
+		t.Errorf("second redirect to the new region returned %v, want nil", err)
+	}
+
+	// The region only switches once per run
+	redirect := redirectError("ap-south-1")
+	if err := u.correctRegion(redirect); !errors.Is(err, redirect) || err == redirect {
+		t.Errorf("redirect to a third region returned %v, want an error naming the region", err)
+	}
+	if u.config.Region != "eu-west-1" {
+		t.Errorf("region switched again to %q", u.config.Region)
+	}
+}
+
+func TestCorrectRegionIgnoresRedirectToCurrentRegion(t *testing.T) {
+	u, _ := newTestUploader(t, t.TempDir(), nil)
+
+	redirect := redirectError("us-east-1")
+	if err := u.correctRegion(redirect); err != redirect {
+		t.Errorf("redirect to the configured region returned %v, want the original error", err)
+	}
+	if u.regionCorrected {
+		t.Error("a redirect to the configured region counted as a switch")
+	}
+}
+
+func TestCorrectRegionPassesOtherErrors(t *testing.T) {
+	u, _ := newTestUploader(t, t.TempDir(), nil)
+
+	denied := apiError("AccessDenied")
+	if err := u.correctRegion(denied); err != denied {
+		t.Errorf("correctRegion(%v) = %v, want it unchanged", denied, err)
+	}
+}
+
+func TestCorrectRegionConcurrentRedirects(t *testing.T) {
+	u, _ := newTestUploader(t, t.TempDir(), nil)
+
+	// Another worker gets the same redirect while the first one logs that it is
+	// switching, after it has claimed the switch
+	var second error
+	var once sync.Once
+	core, _ := observer.New(zapcore.DebugLevel)
+	u.logger = zap.New(core, zap.Hooks(func(zapcore.Entry) error {
+		once.Do(func() {
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				second = u.correctRegion(redirectError("eu-west-1"))
+			}()
+			wg.Wait()
+		})
+		return nil
+	}))
+
+	if err := u.correctRegion(redirectError("eu-west-1")); err != nil {
+		t.Fatalf("first redirect returned %v, want nil", err)
+	}
+	if second != nil {
+		t.Errorf("concurrent redirect to the same region returned %v, want nil so it is retried", second)
+	}
+	if u.config.Region != "eu-west-1" {
+		t.Errorf("region is %q after the redirects, want eu-west-1", u.config.Region)
+	}
+}
@@ -0,0 +1,572 @@
+package uploader
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// minPartSize is the smallest part size S3 accepts for all but the last part
+	minPartSize int64 = 5 * 1024 * 1024
+	// maxParts is the maximum number of parts in a single multipart upload
+	maxParts int64 = 10000
+
+	defaultPartSize           int64 = 16 * 1024 * 1024
+	defaultMultipartThreshold int64 = 100 * 1024 * 1024
+	defaultPartConcurrency          = 1
+
+	defaultMaxRetries     = 3
+	defaultRetryBaseDelay = 500 * time.Millisecond
+	maxRetryDelay         = 30 * time.Second
+	defaultRunRetryDelay  = 30 * time.Second
+
+	defaultTimeout = 24 * time.Hour
+
+	// The SDK's own connection pool settings, which the tuning options start from
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 10
+	defaultIdleConnTimeout     = 90 * time.Second
+
+	defaultSessionName = "aws-s3-uploader"
+)
+
+// User metadata keys set on uploaded objects. S3 returns them with an x-amz-meta- prefix.
+const (
+	MetadataMtime        = "mtime"
+	MetadataOriginalPath = "original-path"
+	MetadataSHA256       = "sha256"
+	MetadataMode         = "mode" // Unix permission bits in octal, e.g. "0755"
+)
+
+// Values for Config.UploadOrder
+const (
+	UploadOrderNone          = "none" // The order files are found in
+	UploadOrderLargestFirst  = "largest-first"
+	UploadOrderSmallestFirst = "smallest-first"
+	UploadOrderAlpha         = "alpha" // By local path
+)
+
+// Values for Config.SyncMode
+const (
+	SyncModeSize = "size" // Size, plus the MD5 with CompareETag
+	SyncModeHash = "hash" // The SHA-256 stored as x-amz-meta-sha256
+)
+
+// Values for Config.Mode
+const (
+	ModeUpload   = "upload"   // Upload local files to S3 (the default)
+	ModeDownload = "download" // Download the objects under S3Prefix to LocalPath
+	ModeMove     = "move"     // Copy the objects under MoveSourcePrefix to S3Prefix within the bucket
+)
+
+// Environment variables read by LoadConfig. They take precedence over the config file.
+const (
+	EnvBucket = "S3_UPLOADER_BUCKET"
+	EnvPrefix = "S3_UPLOADER_PREFIX"
+)
+
+// awsRegionPattern matches AWS region names such as "us-east-1" or "us-gov-west-1"
+var awsRegionPattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-\d+$`)
+
+// Config holds the configuration for the S3 uploader
+type Config struct {
+	// AWS Configuration
+	AWSProfile       string `json:"aws_profile" yaml:"aws_profile"`
+	AccessKey        string `json:"access_key" yaml:"access_key"`
+	SecretKey        string `json:"secret_key" yaml:"secret_key"`
+	SessionToken     string `json:"session_token,omitempty" yaml:"session_token,omitempty"` // For temporary (STS, SSO or assumed-role) credentials
+	Region           string `json:"region" yaml:"region"`
+	AutoDetectRegion bool   `json:"auto_detect_region,omitempty" yaml:"auto_detect_region,omitempty"` // Switch to the bucket's actual region at startup instead of failing if region is wrong
+
+	// AssumeRole Configuration. The role is assumed using the credentials above as the base identity.
+	AssumeRoleARN string `json:"assume_role_arn,omitempty" yaml:"assume_role_arn,omitempty"`
+	ExternalID    string `json:"external_id,omitempty" yaml:"external_id,omitempty"`
+	SessionName   string `json:"role_session_name,omitempty" yaml:"role_session_name,omitempty"` // Defaults to defaultSessionName
+
+	// S3 Configuration
+	BucketName   string `json:"bucket_name" yaml:"bucket_name"`
+	S3Prefix     string `json:"s3_prefix" yaml:"s3_prefix"`
+	Endpoint     string `json:"endpoint,omitempty" yaml:"endpoint,omitempty"`             // Custom endpoint for S3-compatible services such as MinIO or Wasabi
+	UsePathStyle bool   `json:"use_path_style,omitempty" yaml:"use_path_style,omitempty"` // Path-style addressing, needed by most S3-compatible services
+	UseDualStack bool   `json:"use_dual_stack,omitempty" yaml:"use_dual_stack,omitempty"` // Use the AWS endpoints reachable over IPv6 as well as IPv4
+	UseFIPS      bool   `json:"use_fips,omitempty" yaml:"use_fips,omitempty"`             // Use the AWS FIPS 140 validated endpoints
+
+	// RequestPayer acknowledges that this account pays for requests to a requester-pays
+	// bucket; without it such buckets reject every request with AccessDenied
+	RequestPayer bool `json:"request_payer,omitempty" yaml:"request_payer,omitempty"`
+
+	// UseAccelerate sends uploads through S3 Transfer Acceleration, which must be enabled
+	// on the bucket and is billed per GB on top of normal transfer costs
+	UseAccelerate bool `json:"use_accelerate,omitempty" yaml:"use_accelerate,omitempty"`
+
+	// Network Configuration. Without HTTPProxy, the HTTPS_PROXY, HTTP_PROXY and NO_PROXY
+	// environment variables apply. CACertFile is trusted in addition to the system roots.
+	HTTPProxy  string `json:"http_proxy,omitempty" yaml:"http_proxy,omitempty"`     // e.g. "http://proxy.example.com:3128"
+	CACertFile string `json:"ca_cert_file,omitempty" yaml:"ca_cert_file,omitempty"` // PEM bundle, e.g. a corporate proxy's CA
+
+	// InsecureSkipVerify disables TLS certificate verification, for local test servers
+	// with self-signed certificates only. Prefer CACertFile.
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty" yaml:"insecure_skip_verify,omitempty"`
+
+	// Connection pool tuning. MaxIdleConnsPerHost defaults to the most requests that can be
+	// in flight at once, MaxConcurrency times PartConcurrency, so workers reuse connections
+	// instead of opening new ones. MaxIdleConns (default 100) is raised to match if needed,
+	// and idle connections are closed after IdleConnTimeout (default "90s").
+	MaxIdleConnsPerHost int    `json:"max_idle_conns_per_host,omitempty" yaml:"max_idle_conns_per_host,omitempty"`
+	MaxIdleConns        int    `json:"max_idle_conns,omitempty" yaml:"max_idle_conns,omitempty"`
+	IdleConnTimeout     string `json:"idle_conn_timeout,omitempty" yaml:"idle_conn_timeout,omitempty"`
+
+	// KeyTemplate is a text/template for each object's key below S3Prefix, e.g.
+	// "{{.Date}}/{{.RelPath}}". Defaults to the relative path.
+	KeyTemplate string `json:"key_template,omitempty" yaml:"key_template,omitempty"`
+
+	// Flatten drops subdirectories so every file is stored directly under S3Prefix
+	Flatten bool `json:"flatten,omitempty" yaml:"flatten,omitempty"`
+
+	// StripPrefix is removed from the start of each file's relative path before S3Prefix
+	// is added, e.g. "exports/2024". Paths that don't start with it are kept whole.
+	StripPrefix string `json:"strip_prefix,omitempty" yaml:"strip_prefix,omitempty"`
+
+	// SanitizeKeys replaces control characters, invalid UTF-8 and characters such as
+	// "#" or "%" with "_" in each key below its prefix, and shortens keys over S3's
+	// 1024-byte limit. Without it, such keys are logged or fail the file.
+	SanitizeKeys bool `json:"sanitize_keys,omitempty" yaml:"sanitize_keys,omitempty"`
+
+	// LowercaseKeys lowercases each key below its prefix, for consumers that treat keys case-insensitively
+	LowercaseKeys bool `json:"lowercase_keys,omitempty" yaml:"lowercase_keys,omitempty"`
+
+	// CreateFolderMarkers uploads a zero-byte "dir/" object for each empty directory
+	CreateFolderMarkers bool `json:"create_folder_markers,omitempty" yaml:"create_folder_markers,omitempty"`
+
+	// Buckets lists further buckets every file is uploaded to in the same pass, after BucketName
+	Buckets []BucketTarget `json:"buckets,omitempty" yaml:"buckets,omitempty"`
+
+	// Local Configuration
+	LocalPath string `json:"local_path" yaml:"local_path"` // A directory, or a single file uploaded under its base name
+
+	// Sources are additional local paths uploaded in the same run, each under its own prefix
+	Sources []Source `json:"sources,omitempty" yaml:"sources,omitempty"`
+
+	// IncludeHidden uploads files and directories whose names start with "." (default
+	// true). Set it to false to leave them out, e.g. .git or .env.
+	IncludeHidden *bool `json:"include_hidden,omitempty" yaml:"include_hidden,omitempty"`
+
+	// SkipUnreadable skips files and directories the walk has no permission to read,
+	// logging a warning for each and listing them in the summary (default true). Set it
+	// to false to fail the run on the first one instead.
+	SkipUnreadable *bool `json:"skip_unreadable,omitempty" yaml:"skip_unreadable,omitempty"`
+
+	// MaxDepth, if set, limits how many directory levels below each source are walked:
+	// 0 takes only the files directly in it, 1 those one directory down as well, and so on
+	MaxDepth *int `json:"max_depth,omitempty" yaml:"max_depth,omitempty"`
+
+	// FileList names a file listing the paths to upload, one per line, or "-" for
+	// standard input. It replaces walking the sources, which still determine the keys.
+	FileList string `json:"file_list,omitempty" yaml:"file_list,omitempty"`
+
+	// Optional Configuration
+	Pattern         string   `json:"pattern,omitempty" yaml:"pattern,omitempty"`
+	Patterns        []string `json:"patterns,omitempty" yaml:"patterns,omitempty"`                 // Files matching any pattern are included
+	ExcludePatterns []string `json:"exclude_patterns,omitempty" yaml:"exclude_patterns,omitempty"` // Files matching any exclude pattern are dropped, even if included
+	IgnoreFile      string   `json:"ignore_file,omitempty" yaml:"ignore_file,omitempty"`           // .gitignore-style file, relative to the first source unless absolute
+	FollowSymlinks  bool     `json:"follow_symlinks,omitempty" yaml:"follow_symlinks,omitempty"`   // Descend into symlinked directories
+	WalkConcurrency int      `json:"walk_concurrency,omitempty" yaml:"walk_concurrency,omitempty"` // Directories listed at once; 1 walks sequentially
+	MinSize         string   `json:"min_size,omitempty" yaml:"min_size,omitempty"`                 // Skip files smaller than this, e.g. "1MB"
+	MaxSize         string   `json:"max_size,omitempty" yaml:"max_size,omitempty"`                 // Skip files larger than this, e.g. "100MB"
+	ModifiedAfter   string   `json:"modified_after,omitempty" yaml:"modified_after,omitempty"`     // RFC 3339 time or duration relative to now, e.g. "-24h"
+	ModifiedBefore  string   `json:"modified_before,omitempty" yaml:"modified_before,omitempty"`   // Same format as ModifiedAfter
+	MaxConcurrency  int      `json:"max_concurrency,omitempty" yaml:"max_concurrency,omitempty"`
+	LogLevel        string   `json:"log_level,omitempty" yaml:"log_level,omitempty"`
+	LogFormat       string   `json:"log_format,omitempty" yaml:"log_format,omitempty"`       // "json" or "console"; defaults to console on a terminal
+	LogFile         string   `json:"log_file,omitempty" yaml:"log_file,omitempty"`           // Also append JSON logs to this file
+	NoProgress      bool     `json:"no_progress,omitempty" yaml:"no_progress,omitempty"`     // Log progress lines instead of drawing a bar
+	MetricsAddr     string   `json:"metrics_addr,omitempty" yaml:"metrics_addr,omitempty"`   // Serve Prometheus metrics on this address, e.g. ":9090"
+	OTLPEndpoint    string   `json:"otlp_endpoint,omitempty" yaml:"otlp_endpoint,omitempty"` // Export traces over OTLP/HTTP, e.g. "http://localhost:4318"
+
+	// CaseInsensitivePatterns matches include, exclude and rule patterns regardless of
+	// case, so "*.JPG" also selects "photo.jpg" as on macOS and Windows filesystems
+	CaseInsensitivePatterns bool `json:"case_insensitive_patterns,omitempty" yaml:"case_insensitive_patterns,omitempty"`
+
+	// UploadOrder sorts the files before uploading: UploadOrderLargestFirst,
+	// UploadOrderSmallestFirst, UploadOrderAlpha or UploadOrderNone (the default)
+	UploadOrder string `json:"upload_order,omitempty" yaml:"upload_order,omitempty"`
+
+	// DedupByHash uploads each distinct content once per run. Later files with the same
+	// SHA-256 are copied server-side from the first object instead of uploaded again.
+	DedupByHash bool `json:"dedup_by_hash,omitempty" yaml:"dedup_by_hash,omitempty"`
+
+	// AdaptiveConcurrency starts with a few workers and tunes the count up to
+	// MaxConcurrency based on throughput and throttling
+	AdaptiveConcurrency bool `json:"adaptive_concurrency,omitempty" yaml:"adaptive_concurrency,omitempty"`
+
+	// Multipart Configuration (sizes in bytes)
+	MultipartThreshold int64 `json:"multipart_threshold,omitempty" yaml:"multipart_threshold,omitempty"`
+	PartSize           int64 `json:"part_size,omitempty" yaml:"part_size,omitempty"`
+
+	// PartConcurrency is how many parts of one file upload at once, on top of the
+	// MaxConcurrency files in flight. Defaults to 1, uploading parts one after another.
+	PartConcurrency int `json:"part_concurrency,omitempty" yaml:"part_concurrency,omitempty"`
+
+	// UseMmap reads file contents for upload through a memory mapping instead of read
+	// calls, falling back to reading when the file can't be mapped
+	UseMmap bool `json:"use_mmap,omitempty" yaml:"use_mmap,omitempty"`
+
+	// MaxBandwidth caps the combined upload rate of all workers, in bytes per second
+	// with an optional unit such as "512KB" or "5MB". Unlimited when empty.
+	MaxBandwidth string `json:"max_bandwidth,omitempty" yaml:"max_bandwidth,omitempty"`
+
+	// ExpectedThroughput is the upload rate, as a size per second such as "50MB", used to
+	// estimate how long a run will take before any throughput has been measured.
+	// MaxBandwidth is used when it is empty.
+	ExpectedThroughput string `json:"expected_throughput,omitempty" yaml:"expected_throughput,omitempty"`
+
+	// ScanFirst walks every source before uploading anything, so the number of files,
+	// their total size and the estimated duration are logged before the first upload
+	ScanFirst bool `json:"scan_first,omitempty" yaml:"scan_first,omitempty"`
+
+	// MaxRequestsPerSecond caps the combined rate of S3 requests from all workers, which
+	// is lowered further while S3 responds with SlowDown. Unlimited when zero.
+	MaxRequestsPerSecond int `json:"max_requests_per_second,omitempty" yaml:"max_requests_per_second,omitempty"`
+
+	// Retry Configuration
+	MaxRetries     int    `json:"max_retries,omitempty" yaml:"max_retries,omitempty"`
+	RetryBaseDelay string `json:"retry_base_delay,omitempty" yaml:"retry_base_delay,omitempty"`
+
+	// SDKMaxAttempts and SDKMaxBackoff tune the AWS SDK's built-in retryer, which retries
+	// each request before MaxRetries does. The SDK defaults are 3 attempts and 20s.
+	SDKMaxAttempts int    `json:"sdk_max_attempts,omitempty" yaml:"sdk_max_attempts,omitempty"`
+	SDKMaxBackoff  string `json:"sdk_max_backoff,omitempty" yaml:"sdk_max_backoff,omitempty"`
+
+	// RunRetries re-uploads the files that still failed at the end of a run, up to this
+	// many more rounds, waiting RunRetryDelay (default 30s) before each round
+	RunRetries    int    `json:"run_retries,omitempty" yaml:"run_retries,omitempty"`
+	RunRetryDelay string `json:"run_retry_delay,omitempty" yaml:"run_retry_delay,omitempty"`
+
+	// Timeout Configuration (duration strings such as "2h" or "10m")
+	Timeout     string `json:"timeout,omitempty" yaml:"timeout,omitempty"`           // Bounds the whole run; defaults to 24h
+	FileTimeout string `json:"file_timeout,omitempty" yaml:"file_timeout,omitempty"` // Bounds each file, including retries; unlimited by default
+
+	// Object Configuration
+	DetectContentType    *bool             `json:"detect_content_type,omitempty" yaml:"detect_content_type,omitempty"`
+	ContentTypeOverrides map[string]string `json:"content_type_overrides,omitempty" yaml:"content_type_overrides,omitempty"`
+	MimeMapFile          string            `json:"mime_map_file,omitempty" yaml:"mime_map_file,omitempty"`             // JSON map of extension to content type, below ContentTypeOverrides in precedence
+	PreserveMtime        bool              `json:"preserve_mtime,omitempty" yaml:"preserve_mtime,omitempty"`           // Store the file's modification time as x-amz-meta-mtime
+	StoreOriginalPath    bool              `json:"store_original_path,omitempty" yaml:"store_original_path,omitempty"` // Store the relative local path as x-amz-meta-original-path
+	SidecarMetadata      bool              `json:"sidecar_metadata,omitempty" yaml:"sidecar_metadata,omitempty"`       // Read per-file attributes from "<file>.meta.json" next to each file
+
+	// PreservePermissions stores each file's permission bits as x-amz-meta-mode, and
+	// download mode restores them
+	PreservePermissions bool `json:"preserve_permissions,omitempty" yaml:"preserve_permissions,omitempty"`
+
+	// HTTP headers stored with each object. HeaderRules override them per pattern;
+	// the first matching rule wins and its empty fields fall back to these defaults.
+	CacheControl       string       `json:"cache_control,omitempty" yaml:"cache_control,omitempty"`             // e.g. "max-age=3600"
+	ContentDisposition string       `json:"content_disposition,omitempty" yaml:"content_disposition,omitempty"` // e.g. "attachment"
+	HeaderRules        []HeaderRule `json:"header_rules,omitempty" yaml:"header_rules,omitempty"`
+
+	// ACL is a canned ACL such as "private" or "public-read". Buckets with ACLs disabled
+	// (the default for new buckets) reject any value other than "bucket-owner-full-control".
+	ACL string `json:"acl,omitempty" yaml:"acl,omitempty"`
+
+	// Storage Class Configuration
+	StorageClass      string             `json:"storage_class,omitempty" yaml:"storage_class,omitempty"`             // e.g. "STANDARD_IA" or "GLACIER"; defaults to STANDARD
+	StorageClassRules []StorageClassRule `json:"storage_class_rules,omitempty" yaml:"storage_class_rules,omitempty"` // Per-pattern storage classes; the first matching rule wins
+
+	// Tier tags every object with tier=<Tier> ("hot", "warm", "cold" or "archive") so a
+	// lifecycle rule can transition it later. With TierStorageClass the tier also picks
+	// the initial storage class when StorageClass is unset.
+	Tier             string `json:"tier,omitempty" yaml:"tier,omitempty"`
+	TierStorageClass bool   `json:"tier_storage_class,omitempty" yaml:"tier_storage_class,omitempty"`
+
+	// Tags are applied to every object. Values may contain the placeholders
+	// {run_id}, {hostname}, {user} and {rel_path}.
+	Tags map[string]string `json:"tags,omitempty" yaml:"tags,omitempty"`
+
+	// Encryption Configuration
+	ServerSideEncryption string `json:"server_side_encryption,omitempty" yaml:"server_side_encryption,omitempty"` // "AES256" (SSE-S3) or "aws:kms" (SSE-KMS)
+	KMSKeyID             string `json:"kms_key_id,omitempty" yaml:"kms_key_id,omitempty"`                         // Only valid with "aws:kms"; defaults to the AWS managed key
+
+	// ObjectLockMode ("GOVERNANCE" or "COMPLIANCE") puts each object under Object Lock
+	// retention until ObjectLockRetainUntil, an RFC 3339 time or a duration such as
+	// "8760h" counted from when the object is written. The bucket must have Object Lock enabled.
+	ObjectLockMode        string `json:"object_lock_mode,omitempty" yaml:"object_lock_mode,omitempty"`
+	ObjectLockRetainUntil string `json:"object_lock_retain_until,omitempty" yaml:"object_lock_retain_until,omitempty"`
+
+	// Gzip compresses files on the fly and stores them with Content-Encoding: gzip. Only
+	// files matching GzipPatterns are compressed if any are set; already-compressed
+	// formats such as .zip or .jpg never are. GzipExtension (default ".gz") is appended to the key.
+	Gzip          bool     `json:"gzip,omitempty" yaml:"gzip,omitempty"`
+	GzipPatterns  []string `json:"gzip_patterns,omitempty" yaml:"gzip_patterns,omitempty"`
+	GzipExtension *string  `json:"gzip_extension,omitempty" yaml:"gzip_extension,omitempty"`
+
+	// VerifyIntegrity sends a Content-MD5 with each object or part so S3 rejects
+	// anything corrupted in transit. Each file is read twice.
+	VerifyIntegrity bool `json:"verify_integrity,omitempty" yaml:"verify_integrity,omitempty"`
+
+	// ChecksumAlgorithm has the SDK send a checksum of each object or part, computed
+	// while uploading, which S3 validates: "CRC32", "CRC32C", "SHA1" or "SHA256".
+	// Unlike VerifyIntegrity, files are only read once.
+	ChecksumAlgorithm string `json:"checksum_algorithm,omitempty" yaml:"checksum_algorithm,omitempty"`
+
+	// StoreChecksum stores the hex SHA-256 of each file's contents as x-amz-meta-sha256,
+	// which unlike the ETag is the same however the object was uploaded. Each file is read twice.
+	StoreChecksum bool `json:"store_checksum,omitempty" yaml:"store_checksum,omitempty"`
+
+	// VerifyAfterUpload checks each object's size with HeadObject after uploading it
+	VerifyAfterUpload bool `json:"verify_after_upload,omitempty" yaml:"verify_after_upload,omitempty"`
+
+	// Incremental Configuration
+	SkipExisting bool `json:"skip_existing,omitempty" yaml:"skip_existing,omitempty"`
+	CompareETag  bool `json:"compare_etag,omitempty" yaml:"compare_etag,omitempty"`
+
+	// SyncMode is how SkipExisting decides a file is unchanged: SyncModeSize (the default)
+	// or SyncModeHash, which compares the local file's SHA-256 with the one stored on the
+	// object and stores it on every upload, as StoreChecksum does
+	SyncMode string `json:"sync_mode,omitempty" yaml:"sync_mode,omitempty"`
+
+	// NoOverwrite makes every write conditional on the key not existing yet (If-None-Match: *),
+	// so S3 itself refuses to replace an object. Such files are skipped.
+	NoOverwrite bool `json:"no_overwrite,omitempty" yaml:"no_overwrite,omitempty"`
+
+	// DryRun logs what would be uploaded without making any calls to S3
+	DryRun bool `json:"dry_run,omitempty" yaml:"dry_run,omitempty"`
+
+	// Mode is ModeUpload (the default) or ModeDownload, which restores the objects under
+	// S3Prefix into LocalPath, mirroring their keys
+	Mode string `json:"mode,omitempty" yaml:"mode,omitempty"`
+
+	// MoveSourcePrefix is the prefix ModeMove copies objects from, server-side, to S3Prefix.
+	// The source objects are only deleted once copied, one DeleteObject each, when
+	// DeleteSource is also set.
+	MoveSourcePrefix string `json:"move_source_prefix,omitempty" yaml:"move_source_prefix,omitempty"`
+	DeleteSource     bool   `json:"delete_source,omitempty" yaml:"delete_source,omitempty"`
+
+	// StateFile, if set, records each completed upload so an interrupted run can be
+	// resumed without uploading those files again
+	StateFile string `json:"state_file,omitempty" yaml:"state_file,omitempty"`
+
+	// EventLog, if set, is a file to which a JSON line is appended for every file as it
+	// finishes, giving its path, key, size, ETag, duration and status
+	EventLog string `json:"event_log,omitempty" yaml:"event_log,omitempty"`
+
+	// ReportPath, if set, is where a JSON summary of the run is written
+	ReportPath string `json:"report_path,omitempty" yaml:"report_path,omitempty"`
+
+	// GeneratePresignedURLs creates a download link for each uploaded file, valid for
+	// PresignExpiry (a duration such as "24h"; default 1h, at most 7 days)
+	GeneratePresignedURLs bool   `json:"generate_presigned_urls,omitempty" yaml:"generate_presigned_urls,omitempty"`
+	PresignExpiry         string `json:"presign_expiry,omitempty" yaml:"presign_expiry,omitempty"`
+
+	// GenerateManifest uploads a list of every object written or already up to date
+	// after a successful run. ManifestKey defaults to "manifest.json" under S3Prefix;
+	// a key ending in ".csv" gets CSV instead of JSON.
+	GenerateManifest bool   `json:"generate_manifest,omitempty" yaml:"generate_manifest,omitempty"`
+	ManifestKey      string `json:"manifest_key,omitempty" yaml:"manifest_key,omitempty"`
+
+	// DeleteAfterUpload removes each local file once it has been uploaded successfully
+	DeleteAfterUpload bool `json:"delete_after_upload,omitempty" yaml:"delete_after_upload,omitempty"`
+
+	// Mirror deletes objects under S3Prefix that have no matching local file after uploading
+	Mirror bool `json:"mirror,omitempty" yaml:"mirror,omitempty"`
+}
+
+// Source is a local path uploaded under S3Prefix joined with its own prefix
+type Source struct {
+	LocalPath string `json:"local_path" yaml:"local_path"`
+	S3Prefix  string `json:"s3_prefix,omitempty" yaml:"s3_prefix,omitempty"`
+}
+
+// StorageClassRule assigns a storage class to files matching a pattern
+type StorageClassRule struct {
+	Pattern      string `json:"pattern" yaml:"pattern"`
+	StorageClass string `json:"storage_class" yaml:"storage_class"`
+}
+
+// HeaderRule sets HTTP headers for files matching a pattern
+type HeaderRule struct {
+	Pattern            string `json:"pattern" yaml:"pattern"`
+	CacheControl       string `json:"cache_control,omitempty" yaml:"cache_control,omitempty"`
+	ContentDisposition string `json:"content_disposition,omitempty" yaml:"content_disposition,omitempty"`
+}
+
+// IncludePatterns returns the include patterns from both Pattern and Patterns
+func (c *Config) IncludePatterns() []string {
+	var patterns []string
+	if c.Pattern != "" {
+		patterns = append(patterns, c.Pattern)
+	}
+	return append(patterns, c.Patterns...)
+}
+
+// AllSources returns LocalPath, if set, followed by Sources. LocalPath has no prefix of its own.
+func (c *Config) AllSources() []Source {
+	var sources []Source
+	if c.LocalPath != "" {
+		sources = append(sources, Source{LocalPath: c.LocalPath})
+	}
+	return append(sources, c.Sources...)
+}
+
+// LoadConfig loads configuration from one or more JSON files, or YAML files when the
+// extension is .yaml or .yml. Later files are layered over earlier ones, e.g. a shared
+// config.json and then config.prod.json, with mergeConfig. AWS credential and region
+// environment variables, EnvBucket and EnvPrefix override values from the files.
+func LoadConfig(configPaths ...string) (*Config, error) {
+	if len(configPaths) == 0 {
+		return nil, errors.New("no config file given")
+	}
+
+	var config Config
+	for _, configPath := range configPaths {
+		layer, err := readConfigFile(configPath)
+		if err != nil {
+			return nil, err
+		}
+		mergeConfig(&config, layer)
+	}
+
+	config.applyEnv()
+	config.applyDefaults()
+
+	return &config, nil
+}
+
+// readConfigFile decodes a single config file without applying the environment or defaults
+func readConfigFile(configPath string) (*Config, error) {
+	// Open the config file
+	file, err := os.Open(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer file.Close()
+
+	// Decode the file into the Config struct; anything other than YAML is read as JSON
+	var config Config
+	switch strings.ToLower(filepath.Ext(configPath)) {
+	case ".yaml", ".yml":
+		err = yaml.NewDecoder(file).Decode(&config)
+	default:
+		err = json.NewDecoder(file).Decode(&config)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", configPath, err)
+	}
+	return &config, nil
+}
+
+// mergeConfig copies every field that is set in overlay onto c. Maps are merged key by
+// key; any other non-zero value, including a non-empty list, replaces c's. A zero value
+// never overrides, so an overlay can't turn a boolean set by an earlier file back off.
+func mergeConfig(c, overlay *Config) {
+	dst := reflect.ValueOf(c).Elem()
+	src := reflect.ValueOf(overlay).Elem()
+	for i := 0; i < src.NumField(); i++ {
+		field := src.Field(i)
+		if !dst.Type().Field(i).IsExported() || field.IsZero() {
+			continue
+		}
+		target := dst.Field(i)
+		if field.Kind() == reflect.Map && !target.IsNil() {
+			iter := field.MapRange()
+			for iter.Next() {
+				target.SetMapIndex(iter.Key(), iter.Value())
+			}
+			continue
+		}
+		target.Set(field)
+	}
+}
+
+// applyEnv overrides file values with those set in the environment
+func (c *Config) applyEnv() {
+	// Clear static keys from the file so the SDK's default chain picks up the
+	// environment credentials, including AWS_SESSION_TOKEN
+	if os.Getenv("AWS_ACCESS_KEY_ID") != "" && os.Getenv("AWS_SECRET_ACCESS_KEY") != "" {
+		c.AccessKey = ""
+		c.SecretKey = ""
+		c.SessionToken = ""
+		c.AWSProfile = ""
+	}
+
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		c.Region = region
+	}
+
+	if bucket := os.Getenv(EnvBucket); bucket != "" {
+		c.BucketName = bucket
+	}
+
+	if prefix, ok := os.LookupEnv(EnvPrefix); ok {
+		c.S3Prefix = prefix
+	}
+}
+
+// applyDefaults sets default values for optional fields. It is safe to call more than once.
+func (c *Config) applyDefaults() {
+	if c.Pattern == "" && len(c.Patterns) == 0 {
+		c.Pattern = "*" // Match all files by default
+	}
+
+	if c.MaxConcurrency <= 0 {
+		c.MaxConcurrency = runtime.NumCPU() * 2
+	}
+
+	if c.LogLevel == "" {
+		c.LogLevel = "info"
+	}
+
+	if c.PartSize <= 0 {
+		c.PartSize = defaultPartSize
+	}
+
+	if c.MultipartThreshold <= 0 {
+		c.MultipartThreshold = defaultMultipartThreshold
+	}
+
+	c.ChecksumAlgorithm = strings.ToUpper(c.ChecksumAlgorithm)
+	c.ObjectLockMode = strings.ToUpper(c.ObjectLockMode)
+
+	if c.PartConcurrency <= 0 {
+		c.PartConcurrency = defaultPartConcurrency
+	}
+
+	if c.DetectContentType == nil {
+		c.DetectContentType = aws.Bool(true)
+	}
+
+	if c.IncludeHidden == nil {
+		c.IncludeHidden = aws.Bool(true)
+	}
+
+	if c.SkipUnreadable == nil {
+		c.SkipUnreadable = aws.Bool(true)
+	}
+
+	// An explicit "" keeps the original key
+	if c.GzipExtension == nil {
+		c.GzipExtension = aws.String(defaultGzipExtension)
+	}
+
+	// Accept override keys with or without the leading dot
+	overrides := make(map[string]string, len(c.ContentTypeOverrides))
+	for ext, contentType := range c.ContentTypeOverrides {
+		overrides["."+strings.TrimPrefix(strings.ToLower(ext), ".")] = contentType
+	}
+	c.ContentTypeOverrides = overrides
+
+	// A negative value disables retries
+	if c.MaxRetries == 0 {
+		c.MaxRetries = defaultMaxRetries
+	}
+}
@@ -0,0 +1,149 @@
+package uploader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"go.uber.org/zap"
+)
+
+// maxCopySize is the largest object CopyObject can copy in a single request
+const maxCopySize = 5 * 1024 * 1024 * 1024
+
+// dedupIndex records the first file uploaded with each content hash when DedupByHash is set
+type dedupIndex struct {
+	mu      sync.Mutex
+	entries map[string]*dedupEntry
+}
+
+// dedupEntry is the first upload of some content. done is closed once it has finished,
+// after which key, size and err are set.
+type dedupEntry struct {
+	done chan struct{}
+	key  string
+	size int64 // Size stored in S3
+	err  error
+}
+
+// claim returns the entry for hash, creating it if this is the first file with that
+// content, in which case owner is true and the caller must call finish
+func (d *dedupIndex) claim(hash string) (entry *dedupEntry, owner bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if entry, ok := d.entries[hash]; ok {
+		return entry, false
+	}
+	entry = &dedupEntry{done: make(chan struct{})}
+	d.entries[hash] = entry
+	return entry, true
+}
+
+// finish records the outcome of the first upload and releases files waiting on it
+func (e *dedupEntry) finish(key string, size int64, err error) {
+	e.key, e.size, e.err = key, size, err
+	close(e.done)
+}
+
+// objectCopier is implemented by *s3.Client. It isn't part of S3API so injected
+// clients don't have to implement it; with those, duplicates are uploaded normally.
+type objectCopier interface {
+	CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error)
+}
+
+// sendDeduplicated uploads a file with send unless a file with the same content was
+// already uploaded in this run, in which case that object is copied server-side instead.
+// If the first upload failed, or the copy does, the file is uploaded with send after all.
+// It returns the new object's ETag.
+func (u *Uploader) sendDeduplicated(ctx context.Context, file *os.File, input *s3.PutObjectInput, size int64, gzipped bool, send func() (int64, string, error)) (string, error) {
+	hash, err := fileSHA256(io.NewSectionReader(file, 0, size))
+	if err != nil {
+		return "", err
+	}
+	// A compressed object is only a copy of another compressed one
+	if gzipped {
+		hash += "+gzip"
+	}
+
+	entry, owner := u.dedup.claim(hash)
+	if owner {
+		stored, etag, err := send()
+		entry.finish(aws.ToString(input.Key), stored, err)
+		return etag, err
+	}
+
+	select {
+	case <-entry.done:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+
+	s3Key := aws.ToString(input.Key)
+	copier, ok := u.client().(objectCopier)
+	if ok && entry.err == nil && entry.size <= maxCopySize {
+		etag, err := u.copyObject(ctx, copier, entry.key, input)
+		if err == nil {
+			u.logger.Debug("Copied duplicate file",
+				zap.String("key", s3Key),
+				zap.String("source_key", entry.key))
+			return etag, u.finishUpload(ctx, input, entry.size, etag)
+		}
+		u.logger.Warn("Failed to copy duplicate file; uploading it instead",
+			zap.String("key", s3Key),
+			zap.String("source_key", entry.key),
+			zap.Error(err))
+	}
+	_, etag, err := send()
+	return etag, err
+}
+
+// copyObject copies sourceKey to the key in input, replacing the source's metadata and
+// tags with those in input so the copy looks exactly as if it had been uploaded
+func (u *Uploader) copyObject(ctx context.Context, copier objectCopier, sourceKey string, input *s3.PutObjectInput) (string, error) {
+	source := u.config.BucketName + "/" + (&url.URL{Path: sourceKey}).EscapedPath()
+	metadata := input.Metadata
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+
+	var out *s3.CopyObjectOutput
+	err := u.withRetry(ctx, "CopyObject", aws.ToString(input.Key), func() error {
+		var err error
+		out, err = copier.CopyObject(ctx, &s3.CopyObjectInput{
+			Bucket:               input.Bucket,
+			Key:                  input.Key,
+			CopySource:           aws.String(source),
+			RequestPayer:         input.RequestPayer,
+			MetadataDirective:    types.MetadataDirectiveReplace,
+			TaggingDirective:     types.TaggingDirectiveReplace,
+			Metadata:             metadata,
+			Tagging:              input.Tagging,
+			ContentType:          input.ContentType,
+			ContentEncoding:      input.ContentEncoding,
+			CacheControl:         input.CacheControl,
+			ContentDisposition:   input.ContentDisposition,
+			ACL:                  input.ACL,
+			StorageClass:         input.StorageClass,
+			ServerSideEncryption: input.ServerSideEncryption,
+			SSEKMSKeyId:          input.SSEKMSKeyId,
+			ChecksumAlgorithm:    input.ChecksumAlgorithm,
+
+			ObjectLockMode:            input.ObjectLockMode,
+			ObjectLockRetainUntilDate: input.ObjectLockRetainUntilDate,
+		})
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to copy object: %w", err)
+	}
+	if out.CopyObjectResult == nil {
+		return "", nil
+	}
+	return trimETag(out.CopyObjectResult.ETag), nil
+}
@@ -0,0 +1,285 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// objectGetter is implemented by *s3.Client. It isn't part of S3API so injected clients
+// only need it for download mode.
+type objectGetter interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+// download runs UploadWithContext in ModeDownload. Objects under the prefix are listed
+// and handed to the same worker pool uploads use, each saved below LocalPath at its key
+// relative to the prefix.
+func (u *Uploader) download(ctx context.Context) error {
+	if _, ok := u.client().(objectGetter); !ok {
+		return errors.New("download mode needs an S3 client that implements GetObject")
+	}
+	src := u.sources[0]
+	prefix := src.keyPrefix()
+
+	u.logger.Info("Starting download",
+		zap.String("bucket", u.config.BucketName),
+		zap.String("prefix", prefix),
+		zap.String("destination", src.localPath),
+		zap.String("region", u.config.Region),
+		zap.String("run_id", u.runID))
+
+	if !u.config.DryRun {
+		if err := u.checkBucket(ctx); err != nil {
+			return err
+		}
+	}
+
+	prog := u.startProgress()
+	start := time.Now()
+
+	// Objects are downloaded as each page of the listing arrives
+	var totalFiles int
+	var totalSize int64
+	var stats runStats
+	listErr := u.runPass(ctx, prog, &stats, func(send func(LocalFile) error) error {
+		paginator := s3.NewListObjectsV2Paginator(u.client(), &s3.ListObjectsV2Input{
+			Bucket:       aws.String(u.config.BucketName),
+			RequestPayer: u.requestPayer(),
+			Prefix:       aws.String(prefix),
+		})
+		for paginator.HasMorePages() {
+			if err := u.requests.wait(ctx); err != nil {
+				return err
+			}
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return err
+			}
+			for _, obj := range page.Contents {
+				key := aws.ToString(obj.Key)
+				localPath, ok := downloadPath(src.localPath, prefix, key)
+				if !ok {
+					u.logger.Debug("Skipping object that doesn't map to a local file", zap.String("s3_key", key))
+					continue
+				}
+				file := LocalFile{Path: localPath, Size: aws.ToInt64(obj.Size), ModTime: aws.ToTime(obj.LastModified), Key: key}
+				totalFiles++
+				totalSize += file.Size
+				prog.addTotal(file.Size)
+				if err := send(file); err != nil {
+					return err
+				}
+			}
+		}
+		u.logger.Info("Found objects to download",
+			zap.Int("count", totalFiles),
+			zap.Int64("total_bytes", totalSize))
+		return nil
+	})
+
+	if listErr == nil {
+		u.retryFailed(ctx, prog, &stats)
+	}
+
+	prog.finish()
+
+	if listErr != nil && ctx.Err() == nil {
+		return fmt.Errorf("failed to list objects: %w", listErr)
+	}
+
+	return u.finishObjectRun(ctx, "Download", &stats, totalFiles, start)
+}
+
+// finishObjectRun logs the outcome of a download or move run, named by operation, and
+// returns the error UploadWithContext reports for it
+func (u *Uploader) finishObjectRun(ctx context.Context, operation string, stats *runStats, totalFiles int, start time.Time) error {
+	failures := stats.failures
+	sort.Slice(failures, func(i, j int) bool { return failures[i].Path < failures[j].Path })
+
+	if totalFiles == 0 {
+		u.logger.Info("No objects to " + strings.ToLower(operation))
+		return nil
+	}
+
+	if ctx.Err() != nil {
+		u.logger.Warn(operation+" interrupted",
+			zap.Int("succeeded_files", stats.succeeded),
+			zap.Int("skipped_files", stats.skipped),
+			zap.Int("failed_files", len(failures)),
+			zap.Int("remaining_files", totalFiles-stats.processed))
+		return fmt.Errorf("%s interrupted after %d of %d files: %w", strings.ToLower(operation), stats.processed, totalFiles, ctx.Err())
+	}
+
+	if len(failures) > 0 {
+		u.logger.Warn(operation+" completed with errors", zap.Int("failed_files", len(failures)))
+		return &UploadError{Failed: len(failures), Total: totalFiles, Failures: failures}
+	}
+
+	elapsed := time.Since(start)
+	totalBytes := atomic.LoadInt64(&u.bytesUploaded)
+	u.logger.Info(operation+" completed successfully",
+		zap.Int("total_files", totalFiles),
+		zap.Int("skipped_files", stats.skipped),
+		zap.Int64("total_bytes", totalBytes),
+		zap.Duration("duration", elapsed),
+		zap.Float64("throughput_mb_per_sec", throughputMBps(totalBytes, elapsed)))
+	return nil
+}
+
+// downloadPath returns where the object at key is saved below dir. Folder markers and
+// keys that would land outside dir, e.g. through "..", have no local path.
+func downloadPath(dir, prefix, key string) (string, bool) {
+	rel := strings.TrimPrefix(key, prefix)
+	if rel == "" || strings.HasSuffix(rel, "/") {
+		return "", false
+	}
+	localPath := filepath.Join(dir, filepath.FromSlash(rel))
+	if !within(dir, localPath) {
+		return "", false
+	}
+	return localPath, true
+}
+
+// defaultDownloadMode is the permission of a downloaded file without a stored mode
+const defaultDownloadMode fs.FileMode = 0o644
+
+// downloadMode returns the permissions for a downloaded object from its x-amz-meta-mode
+// when PreservePermissions is set, or defaultDownloadMode
+func (u *Uploader) downloadMode(key string, metadata map[string]string) fs.FileMode {
+	stored, ok := metadata[MetadataMode]
+	if !u.config.PreservePermissions || !ok {
+		return defaultDownloadMode
+	}
+	mode, err := strconv.ParseUint(stored, 8, 32)
+	if err != nil || mode > uint64(fs.ModePerm) {
+		u.logger.Warn("Ignoring invalid stored file mode",
+			zap.String("s3_key", key),
+			zap.String("mode", stored))
+		return defaultDownloadMode
+	}
+	return fs.FileMode(mode)
+}
+
+// downloadObject downloads a single object in its own span and returns its size and ETag
+func (u *Uploader) downloadObject(ctx context.Context, job LocalFile) (int64, string, error) {
+	ctx, span := u.tracer.Start(ctx, "downloadObject", trace.WithAttributes(
+		attribute.String("s3.bucket", u.config.BucketName),
+		attribute.String("s3.key", job.Key),
+		attribute.String("file.path", job.Path),
+		attribute.Int64("file.size", job.Size)))
+	size, etag, err := u.fetchObject(ctx, job)
+	endSpan(span, err)
+	return size, etag, err
+}
+
+// fetchObject does the work of downloadObject
+func (u *Uploader) fetchObject(ctx context.Context, job LocalFile) (int64, string, error) {
+	if u.fileTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, u.fileTimeout)
+		defer cancel()
+	}
+
+	if u.config.SkipExisting {
+		if info, err := os.Stat(job.Path); err == nil && info.Mode().IsRegular() && info.Size() == job.Size {
+			u.logger.Debug("Skipping unchanged file",
+				zap.String("s3_key", job.Key),
+				zap.String("file", job.Path))
+			return job.Size, "", ErrSkipped
+		}
+	}
+
+	if u.config.DryRun {
+		u.logger.Info("Dry run: would download object",
+			zap.String("s3_key", job.Key),
+			zap.String("file", job.Path),
+			zap.Int64("size", job.Size))
+		return job.Size, "", nil
+	}
+
+	dir := filepath.Dir(job.Path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return 0, "", fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	// Write to a temporary file next to the target so a failed download never leaves
+	// a truncated file in its place
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(job.Path)+".*.tmp")
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to create file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	var size int64
+	var etag string
+	var metadata map[string]string
+	err = u.withRetry(ctx, "GetObject", job.Key, func() error {
+		// Start over so a retried attempt doesn't append to a partial download
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err := tmp.Truncate(0); err != nil {
+			return err
+		}
+		// download checked that the client has GetObject before any job was started
+		out, err := u.client().(objectGetter).GetObject(ctx, &s3.GetObjectInput{
+			Bucket:       aws.String(u.config.BucketName),
+			RequestPayer: u.requestPayer(),
+			Key:          aws.String(job.Key),
+		})
+		if err != nil {
+			return err
+		}
+		defer out.Body.Close()
+		metadata = out.Metadata
+		etag = trimETag(out.ETag)
+		size, err = io.Copy(tmp, out.Body)
+		return err
+	})
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to download object: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return 0, "", fmt.Errorf("failed to write file: %w", err)
+	}
+	// The temporary file is created private, so give it the usual mode, or the one
+	// stored at upload with PreservePermissions
+	if err := os.Chmod(tmp.Name(), u.downloadMode(job.Key, metadata)); err != nil {
+		return 0, "", fmt.Errorf("failed to set permissions: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), job.Path); err != nil {
+		return 0, "", fmt.Errorf("failed to write file: %w", err)
+	}
+
+	// Restore the modification time recorded at upload, falling back to when the object was written
+	modTime := job.ModTime
+	if mtime, err := time.Parse(time.RFC3339Nano, metadata[MetadataMtime]); err == nil {
+		modTime = mtime
+	}
+	if !modTime.IsZero() {
+		if err := os.Chtimes(job.Path, modTime, modTime); err != nil {
+			u.logger.Warn("Failed to set modification time",
+				zap.String("file", job.Path),
+				zap.Error(err))
+		}
+	}
+	return size, etag, nil
+}
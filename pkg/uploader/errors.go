@@ -0,0 +1,133 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/smithy-go"
+)
+
+// ErrSkipped is returned by UploadFile when a file is deliberately not uploaded, which
+// counts as skipped rather than failed. It is returned as is when the object is already
+// up to date; ErrObjectExists and ErrUnreadable wrap it for the other reasons.
+var ErrSkipped = errors.New("file skipped")
+
+// ErrObjectExists is returned by UploadFile when NoOverwrite is set and S3 refused the
+// upload because the key is taken. It matches ErrSkipped with errors.Is.
+var ErrObjectExists = fmt.Errorf("object already exists and no_overwrite is set: %w", ErrSkipped)
+
+// ErrUnreadable is returned by UploadFile when SkipUnreadable is set and the file can't
+// be opened for lack of permission. It matches ErrSkipped with errors.Is.
+var ErrUnreadable = fmt.Errorf("file is not readable: %w", ErrSkipped)
+
+// existsError returns ErrObjectExists for the error S3 gives a conditional write to a
+// key that exists, and other errors as is
+func existsError(err error) error {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "PreconditionFailed" {
+		return ErrObjectExists
+	}
+	return err
+}
+
+// Process exit codes for the outcome of a run, as returned by ExitCode
+const (
+	ExitSuccess = 0
+	ExitConfig  = 1 // The configuration is invalid; fix it before running again
+	ExitPartial = 2 // Some files failed or the run was interrupted; running again may finish it
+	ExitFailure = 3 // Nothing was transferred, e.g. because of bad credentials or an unreachable bucket
+)
+
+// ExitCode maps an error from LoadConfig, NewUploader or UploadWithContext to one of
+// the Exit constants, so scripts can tell a run worth retrying from a broken setup
+func ExitCode(err error) int {
+	var configErr *ConfigError
+	var uploadErr *UploadError
+	switch {
+	case err == nil:
+		return ExitSuccess
+	case errors.As(err, &configErr):
+		return ExitConfig
+	case errors.As(err, &uploadErr):
+		if uploadErr.Failed < uploadErr.Total {
+			return ExitPartial
+		}
+		return ExitFailure
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return ExitPartial
+	}
+	return ExitFailure
+}
+
+// ConfigError reports a missing or invalid configuration value
+type ConfigError struct {
+	Field   string // JSON name of the offending field, e.g. "bucket_name"
+	Message string
+	Err     error // Underlying error, if any
+}
+
+func (e *ConfigError) Error() string {
+	msg := e.Field + " " + e.Message
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// ConfigErrors collects every problem found while validating a Config
+type ConfigErrors []*ConfigError
+
+func (e ConfigErrors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = "  " + err.Error()
+	}
+	return fmt.Sprintf("%d configuration errors:\n%s", len(e), strings.Join(msgs, "\n"))
+}
+
+// Unwrap lets errors.As find the individual *ConfigError values
+func (e ConfigErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, err := range e {
+		errs[i] = err
+	}
+	return errs
+}
+
+// add appends err, which must be nil or a *ConfigError
+func (e *ConfigErrors) add(err error) {
+	var configErr *ConfigError
+	if errors.As(err, &configErr) {
+		*e = append(*e, configErr)
+	}
+}
+
+// UploadError reports that some files could not be uploaded
+type UploadError struct {
+	Failed   int           // Number of files that failed
+	Total    int           // Number of files found
+	Failures []FileFailure // The files that failed, sorted by path
+}
+
+// FileFailure records why a single file could not be uploaded
+type FileFailure struct {
+	Path string
+	Err  error
+}
+
+func (f FileFailure) Error() string {
+	return f.Path + ": " + f.Err.Error()
+}
+
+func (e *UploadError) Error() string {
+	return fmt.Sprintf("failed to upload %d of %d files", e.Failed, e.Total)
+}
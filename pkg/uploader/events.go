@@ -0,0 +1,78 @@
+package uploader
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// Statuses of an Event
+const (
+	EventSucceeded = "succeeded"
+	EventSkipped   = "skipped"
+	EventFailed    = "failed"
+)
+
+// Event is one line of EventLog, written as each file is finished. In move mode Path is
+// empty and SourceKey holds the object that was moved to Key.
+type Event struct {
+	Time            time.Time `json:"time"`
+	RunID           string    `json:"run_id"`
+	Path            string    `json:"path,omitempty"`
+	SourceKey       string    `json:"source_key,omitempty"`
+	Key             string    `json:"key"`
+	Size            int64     `json:"size"`
+	ETag            string    `json:"etag,omitempty"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Status          string    `json:"status"`
+	Error           string    `json:"error,omitempty"`
+}
+
+// eventLog appends Events to EventLog as JSON lines. A nil eventLog discards them.
+type eventLog struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// openEventLog opens path for appending, creating it if needed
+func openEventLog(path string) (*eventLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &eventLog{file: file, enc: json.NewEncoder(file)}, nil
+}
+
+// write appends a line for event. Each line is a single write, so it is in the file
+// as soon as write returns.
+func (l *eventLog) write(event Event) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.enc.Encode(event)
+}
+
+// close closes the file
+func (l *eventLog) close() error {
+	if l == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// eventStatus returns the Event status for the outcome of a file
+func eventStatus(err error) string {
+	switch {
+	case errors.Is(err, ErrSkipped):
+		return EventSkipped
+	case err != nil:
+		return EventFailed
+	default:
+		return EventSucceeded
+	}
+}
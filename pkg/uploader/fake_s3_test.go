@@ -0,0 +1,282 @@
+package uploader
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// fakeS3 is an in-memory S3API for tests. Objects are stored by key in a single
+// bucket; failures can be queued per operation with failNext.
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	encoding map[string]string           // Content-Encoding of stored objects, by key
+	uploads  map[string]map[int32][]byte // Parts of unfinished multipart uploads, by upload ID
+	aborted  []string                    // Upload IDs passed to AbortMultipartUpload
+	calls    map[string]int
+	failures map[string][]error
+	nextID   int
+
+	// discardBodies drops the content of uploads instead of storing it, so benchmarks
+	// measure the uploader rather than the fake
+	discardBodies bool
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		objects:  make(map[string][]byte),
+		encoding: make(map[string]string),
+		uploads:  make(map[string]map[int32][]byte),
+		calls:    make(map[string]int),
+		failures: make(map[string][]error),
+	}
+}
+
+// failNext makes the next calls to operation fail with errs, one each, in order
+func (f *fakeS3) failNext(operation string, errs ...error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[operation] = append(f.failures[operation], errs...)
+}
+
+// call counts a call to operation and returns the failure queued for it, if any.
+// The caller must hold f.mu.
+func (f *fakeS3) call(operation string) error {
+	f.calls[operation]++
+	if queued := f.failures[operation]; len(queued) > 0 {
+		f.failures[operation] = queued[1:]
+		return queued[0]
+	}
+	return nil
+}
+
+// callCount returns how many times operation was called
+func (f *fakeS3) callCount(operation string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[operation]
+}
+
+// object returns the content stored at key
+func (f *fakeS3) object(key string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.objects[key]
+	return data, ok
+}
+
+// readBody reads an upload's body, returning nothing with discardBodies
+func (f *fakeS3) readBody(body io.Reader) ([]byte, error) {
+	if f.discardBodies {
+		_, err := io.Copy(io.Discard, body)
+		return nil, err
+	}
+	return io.ReadAll(body)
+}
+
+// apiError returns an S3 error with the given code, as the SDK would
+func apiError(code string) error {
+	return &smithy.GenericAPIError{Code: code, Message: code}
+}
+
+func (f *fakeS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	// Read the body outside the lock, as the SDK would while sending it
+	data, err := f.readBody(params.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("PutObject"); err != nil {
+		return nil, err
+	}
+	f.objects[aws.ToString(params.Key)] = data
+	f.encoding[aws.ToString(params.Key)] = aws.ToString(params.ContentEncoding)
+	return &s3.PutObjectOutput{ETag: aws.String(fmt.Sprintf("%q", etagOf(data)))}, nil
+}
+
+func (f *fakeS3) CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("CreateMultipartUpload"); err != nil {
+		return nil, err
+	}
+	f.nextID++
+	id := fmt.Sprintf("upload-%d", f.nextID)
+	f.uploads[id] = make(map[int32][]byte)
+	f.encoding[aws.ToString(params.Key)] = aws.ToString(params.ContentEncoding)
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String(id)}, nil
+}
+
+func (f *fakeS3) UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	data, err := f.readBody(params.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("UploadPart"); err != nil {
+		return nil, err
+	}
+	parts, ok := f.uploads[aws.ToString(params.UploadId)]
+	if !ok {
+		return nil, apiError("NoSuchUpload")
+	}
+	parts[aws.ToInt32(params.PartNumber)] = data
+	return &s3.UploadPartOutput{ETag: aws.String(fmt.Sprintf("%q", etagOf(data)))}, nil
+}
+
+func (f *fakeS3) CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("CompleteMultipartUpload"); err != nil {
+		return nil, err
+	}
+	id := aws.ToString(params.UploadId)
+	parts, ok := f.uploads[id]
+	if !ok {
+		return nil, apiError("NoSuchUpload")
+	}
+
+	var data []byte
+	for _, part := range params.MultipartUpload.Parts {
+		content, ok := parts[aws.ToInt32(part.PartNumber)]
+		if !ok {
+			return nil, apiError("InvalidPart")
+		}
+		data = append(data, content...)
+	}
+	delete(f.uploads, id)
+	f.objects[aws.ToString(params.Key)] = data
+	etag := fmt.Sprintf("%s-%d", etagOf(data), len(params.MultipartUpload.Parts))
+	return &s3.CompleteMultipartUploadOutput{ETag: aws.String(fmt.Sprintf("%q", etag))}, nil
+}
+
+func (f *fakeS3) AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("AbortMultipartUpload"); err != nil {
+		return nil, err
+	}
+	id := aws.ToString(params.UploadId)
+	delete(f.uploads, id)
+	f.aborted = append(f.aborted, id)
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (f *fakeS3) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("CopyObject"); err != nil {
+		return nil, err
+	}
+	// The source is "bucket/key"; everything is in one bucket
+	_, source, _ := strings.Cut(aws.ToString(params.CopySource), "/")
+	data, ok := f.objects[source]
+	if !ok {
+		return nil, apiError("NoSuchKey")
+	}
+	f.objects[aws.ToString(params.Key)] = data
+	f.encoding[aws.ToString(params.Key)] = aws.ToString(params.ContentEncoding)
+	return &s3.CopyObjectOutput{
+		CopyObjectResult: &types.CopyObjectResult{ETag: aws.String(fmt.Sprintf("%q", etagOf(data)))},
+	}, nil
+}
+
+// contentEncoding returns the Content-Encoding the object at key was stored with
+func (f *fakeS3) contentEncoding(key string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.encoding[key]
+}
+
+func (f *fakeS3) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("ListObjectsV2"); err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, aws.ToString(params.Prefix)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	// Everything fits on one page
+	out := &s3.ListObjectsV2Output{IsTruncated: aws.Bool(false)}
+	for _, key := range keys {
+		data := f.objects[key]
+		out.Contents = append(out.Contents, types.Object{
+			Key:  aws.String(key),
+			Size: aws.Int64(int64(len(data))),
+			ETag: aws.String(fmt.Sprintf("%q", etagOf(data))),
+		})
+	}
+	return out, nil
+}
+
+func (f *fakeS3) DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DeleteObjects"); err != nil {
+		return nil, err
+	}
+	for _, obj := range params.Delete.Objects {
+		delete(f.objects, aws.ToString(obj.Key))
+	}
+	return &s3.DeleteObjectsOutput{}, nil
+}
+
+func (f *fakeS3) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DeleteObject"); err != nil {
+		return nil, err
+	}
+	delete(f.objects, aws.ToString(params.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (f *fakeS3) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("HeadObject"); err != nil {
+		return nil, err
+	}
+	data, ok := f.objects[aws.ToString(params.Key)]
+	if !ok {
+		return nil, apiError("NotFound")
+	}
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(int64(len(data)))}, nil
+}
+
+func (f *fakeS3) HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("HeadBucket"); err != nil {
+		return nil, err
+	}
+	return &s3.HeadBucketOutput{}, nil
+}
+
+// etagOf returns the ETag S3 gives a single-part object with the given content
+func etagOf(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,84 @@
+package uploader
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// fileListStdin is the FileList value that reads the list from standard input
+const fileListStdin = "-"
+
+// readFileList calls found with every file named in FileList, in list order. Listed
+// files bypass the include, exclude and filter settings, but each must be inside a source
+// so its key can be computed.
+func (u *Uploader) readFileList(found func(LocalFile) error) error {
+	var r io.Reader = os.Stdin
+	if u.config.FileList != fileListStdin {
+		f, err := os.Open(u.config.FileList)
+		if err != nil {
+			return fmt.Errorf("failed to open file list: %w", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" {
+			continue
+		}
+
+		filePath, err := u.resolveListed(entry)
+		if err != nil {
+			return fmt.Errorf("file list line %d: %w", line, err)
+		}
+		info, err := os.Stat(filePath)
+		if err != nil {
+			return fmt.Errorf("file list line %d: %w", line, err)
+		}
+		if info.IsDir() {
+			return fmt.Errorf("file list line %d: %s is a directory; list files only", line, entry)
+		}
+		if err := found(LocalFile{Path: filePath, Size: info.Size(), ModTime: info.ModTime()}); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read file list: %w", err)
+	}
+	return nil
+}
+
+// resolveListed maps a listed path, absolute or relative to the working directory, to
+// the form a walk of its source would produce, so keys come out the same either way
+func (u *Uploader) resolveListed(entry string) (string, error) {
+	abs, err := filepath.Abs(entry)
+	if err != nil {
+		return "", err
+	}
+	for _, src := range u.sources {
+		srcAbs, err := filepath.Abs(src.localPath)
+		if err != nil {
+			return "", err
+		}
+		if src.isFile() {
+			if abs == srcAbs {
+				return src.localPath, nil
+			}
+			continue
+		}
+		if within(srcAbs, abs) {
+			rel, err := filepath.Rel(srcAbs, abs)
+			if err != nil {
+				return "", err
+			}
+			return filepath.Join(src.localPath, rel), nil
+		}
+	}
+	return "", fmt.Errorf("%s is not inside any source", entry)
+}
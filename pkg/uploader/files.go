@@ -0,0 +1,632 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/bmatcuk/doublestar/v4"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+// LocalFile is a file selected for upload
+type LocalFile struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+	Dir     bool   // An empty directory uploaded as a folder marker (see CreateFolderMarkers)
+	Key     string // The object downloaded to Path in download mode, or moved to the key in Path in move mode
+
+	storageClass string // Of the object being moved, which the copy keeps
+}
+
+// FindFiles walks each source and returns the files selected by the include and exclude
+// patterns. A source that is a single file is returned as is.
+func (u *Uploader) FindFiles() ([]LocalFile, error) {
+	return u.collectFiles(context.Background())
+}
+
+// ListFiles returns the files an upload with c would select, after every pattern, size,
+// modification time and state file filter, without creating an S3 client
+func (c *Config) ListFiles() ([]LocalFile, error) {
+	if c.Mode != "" && c.Mode != ModeUpload {
+		return nil, &ConfigError{Field: "mode", Message: fmt.Sprintf("must be %q to list files: %q", ModeUpload, c.Mode)}
+	}
+	u, err := newUploader(c)
+	if err != nil {
+		return nil, err
+	}
+	return u.FindFiles()
+}
+
+// collectFiles is FindFiles with ctx as the parent of the walk's span
+func (u *Uploader) collectFiles(ctx context.Context) ([]LocalFile, error) {
+	var files []LocalFile
+	err := u.findFiles(ctx, func(file LocalFile) error {
+		files = append(files, file)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// findFiles walks each source and calls found with every selected file as soon as it
+// is seen, so uploads can start before the walk is over. Folder markers come last,
+// since a directory is only known to be empty once the whole walk is done. An error
+// from found stops the walk.
+func (u *Uploader) findFiles(ctx context.Context, found func(LocalFile) error) (err error) {
+	_, span := u.tracer.Start(ctx, "findFiles")
+	selected := 0
+	defer func() {
+		span.SetAttributes(attribute.Int("files.selected", selected))
+		endSpan(span, err)
+	}()
+	report := found
+	found = func(file LocalFile) error {
+		selected++
+		return report(file)
+	}
+
+	// An explicit list replaces the walk
+	if u.config.FileList != "" {
+		return u.readFileList(found)
+	}
+
+	patterns := u.config.IncludePatterns()
+	patternCounts := make(map[string]int, len(patterns))
+	sizeFiltered, timeFiltered, alreadyDone, unstripped, tooDeep := 0, 0, 0, 0, 0
+
+	// With CreateFolderMarkers, tracks whether anything will be uploaded below each directory
+	dirHasContent := make(map[string]bool)
+	markContent := func(root, relPath string) {
+		for dir := filepath.Dir(relPath); dir != "."; dir = filepath.Dir(dir) {
+			dirHasContent[filepath.Join(root, dir)] = true
+		}
+	}
+
+	for _, src := range u.sources {
+		if src.isFile() {
+			info, err := os.Stat(src.localPath)
+			if err != nil {
+				return err
+			}
+			if err := found(LocalFile{Path: src.localPath, Size: info.Size(), ModTime: info.ModTime()}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		realRoot, err := filepath.EvalSymlinks(src.localPath)
+		if err != nil {
+			return err
+		}
+
+		visit := func(path string, info os.FileInfo) error {
+			relPath, err := filepath.Rel(src.localPath, path)
+			if err != nil {
+				return err
+			}
+
+			// Hidden directories are not descended into when IncludeHidden is false
+			if relPath != "." && u.isHidden(info.Name()) {
+				u.logger.Debug("Skipping hidden file", zap.String("path", path), zap.Bool("dir", info.IsDir()))
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			// Excludes take precedence over includes; excluded directories are not descended into
+			if relPath != "." {
+				excluded, err := u.isExcluded(relPath, info.IsDir())
+				if err != nil {
+					return err
+				}
+				if excluded {
+					if info.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+			}
+
+			if info.IsDir() {
+				// Files in a directory at the depth limit would be beyond it
+				if u.config.MaxDepth != nil && relPath != "." && strings.Count(relPath, string(filepath.Separator)) >= *u.config.MaxDepth {
+					tooDeep++
+					// The directory isn't empty, so its parent doesn't need a marker either
+					if u.config.CreateFolderMarkers {
+						markContent(src.localPath, relPath)
+					}
+					return filepath.SkipDir
+				}
+				if u.config.CreateFolderMarkers && relPath != "." {
+					if _, ok := dirHasContent[path]; !ok {
+						dirHasContent[path] = false
+					}
+					markContent(src.localPath, relPath)
+				}
+				return nil
+			}
+
+			// An empty pattern list matches everything
+			included := len(patterns) == 0
+			for _, pattern := range patterns {
+				matched, err := u.matchPattern(pattern, relPath)
+				if err != nil {
+					return err
+				}
+				if matched {
+					patternCounts[pattern]++
+					included = true
+				}
+			}
+
+			if included && !u.sizeInRange(info.Size()) {
+				sizeFiltered++
+				included = false
+			}
+
+			if included && !u.modTimeInRange(info.ModTime()) {
+				timeFiltered++
+				included = false
+			}
+
+			// Files recorded in the state file by an earlier run are done already
+			if included && u.state != nil {
+				s3Key, err := u.s3Key(path)
+				if err != nil {
+					return err
+				}
+				if u.state.done(s3Key, info.Size(), info.ModTime()) {
+					alreadyDone++
+					markContent(src.localPath, relPath)
+					included = false
+				}
+			}
+
+			if included {
+				if _, ok := u.stripRel(filepath.ToSlash(relPath)); !ok {
+					unstripped++
+				}
+				markContent(src.localPath, relPath)
+				return found(LocalFile{Path: path, Size: info.Size(), ModTime: info.ModTime()})
+			}
+
+			return nil
+		}
+
+		if u.config.WalkConcurrency > 1 {
+			err = u.walkParallel(src.localPath, realRoot, u.config.WalkConcurrency, visit)
+		} else {
+			err = u.walk(src.localPath, realRoot, make(map[string]bool), visit)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Only leaf directories get markers; their parents exist implicitly in S3
+	var emptyDirs []string
+	for dir, hasContent := range dirHasContent {
+		if !hasContent {
+			emptyDirs = append(emptyDirs, dir)
+		}
+	}
+	sort.Strings(emptyDirs)
+	for _, dir := range emptyDirs {
+		if err := found(LocalFile{Path: dir, Dir: true}); err != nil {
+			return err
+		}
+	}
+
+	for _, pattern := range patterns {
+		u.logger.Debug("Pattern matches",
+			zap.String("pattern", pattern),
+			zap.Int("count", patternCounts[pattern]))
+	}
+
+	if sizeFiltered > 0 {
+		u.logger.Info("Skipped files outside the size range",
+			zap.Int("count", sizeFiltered),
+			zap.String("min_size", u.config.MinSize),
+			zap.String("max_size", u.config.MaxSize))
+	}
+
+	if tooDeep > 0 {
+		u.logger.Info("Skipped directories below max_depth",
+			zap.Int("count", tooDeep),
+			zap.Int("max_depth", *u.config.MaxDepth))
+	}
+
+	if alreadyDone > 0 {
+		u.logger.Info("Skipped files already uploaded according to the state file",
+			zap.Int("count", alreadyDone),
+			zap.String("state_file", u.config.StateFile))
+	}
+
+	if unstripped > 0 {
+		u.logger.Warn("Files don't start with strip_prefix and keep their full relative path",
+			zap.Int("count", unstripped),
+			zap.String("strip_prefix", u.config.StripPrefix))
+	}
+
+	if timeFiltered > 0 {
+		u.logger.Info("Skipped files outside the modification time range",
+			zap.Int("count", timeFiltered),
+			zap.Time("modified_after", u.modifiedAfter),
+			zap.Time("modified_before", u.modifiedBefore))
+	}
+
+	return nil
+}
+
+// sizeInRange reports whether a file of the given size passes MinSize and MaxSize
+func (u *Uploader) sizeInRange(size int64) bool {
+	if u.minSize > 0 && size < u.minSize {
+		return false
+	}
+	if u.maxSize > 0 && size > u.maxSize {
+		return false
+	}
+	return true
+}
+
+// modTimeInRange reports whether a modification time passes ModifiedAfter and ModifiedBefore
+func (u *Uploader) modTimeInRange(modTime time.Time) bool {
+	if !u.modifiedAfter.IsZero() && !modTime.After(u.modifiedAfter) {
+		return false
+	}
+	if !u.modifiedBefore.IsZero() && !modTime.Before(u.modifiedBefore) {
+		return false
+	}
+	return true
+}
+
+// skipUnreadable reports whether err, hit while reading path, is a permission error
+// that SkipUnreadable lets the run skip. If so it logs a warning and records path for
+// the summary.
+func (u *Uploader) skipUnreadable(path string, err error) bool {
+	if !aws.ToBool(u.config.SkipUnreadable) || !errors.Is(err, fs.ErrPermission) {
+		return false
+	}
+	u.logger.Warn("Skipping unreadable path", zap.String("path", path), zap.Error(err))
+
+	u.unreadableMu.Lock()
+	u.unreadable = append(u.unreadable, path)
+	u.unreadableMu.Unlock()
+	return true
+}
+
+// unreadablePaths returns the paths skipped by skipUnreadable so far, sorted, including
+// those the replicas skipped
+func (u *Uploader) unreadablePaths() []string {
+	u.unreadableMu.Lock()
+	paths := slices.Clone(u.unreadable)
+	u.unreadableMu.Unlock()
+	for _, r := range u.replicas {
+		paths = append(paths, r.uploader.unreadablePaths()...)
+	}
+	sort.Strings(paths)
+	return slices.Compact(paths)
+}
+
+// walk walks realRoot, calling fn with paths rewritten to be under root so files inside
+// a symlinked directory keep the link's path. Symlinks to files are passed to fn as files.
+// Symlinked directories are descended into only with FollowSymlinks; visited holds the
+// real path of every directory walked so far so a link back to one of them is not
+// followed again, which would otherwise loop forever.
+func (u *Uploader) walk(root, realRoot string, visited map[string]bool, fn func(path string, info os.FileInfo) error) error {
+	return filepath.WalkDir(realRoot, func(realPath string, d fs.DirEntry, walkErr error) error {
+		rel, err := filepath.Rel(realRoot, realPath)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(root, rel)
+
+		if walkErr != nil {
+			if u.skipUnreadable(path, walkErr) {
+				return nil
+			}
+			return walkErr
+		}
+
+		if d.Type()&fs.ModeSymlink == 0 {
+			if d.IsDir() {
+				visited[realPath] = true
+			}
+			info, err := d.Info()
+			if err != nil {
+				if u.skipUnreadable(path, err) {
+					return nil
+				}
+				return err
+			}
+			return fn(path, info)
+		}
+
+		// Stat follows the link, so info describes the target
+		info, err := os.Stat(realPath)
+		if err != nil {
+			u.logger.Debug("Skipping broken symlink", zap.String("path", path), zap.Error(err))
+			return nil
+		}
+		if !info.IsDir() {
+			return fn(path, info)
+		}
+
+		if !u.config.FollowSymlinks {
+			u.logger.Debug("Skipping symlinked directory", zap.String("path", path))
+			return nil
+		}
+
+		target, err := filepath.EvalSymlinks(realPath)
+		if err != nil {
+			return err
+		}
+		if visited[target] {
+			u.logger.Debug("Skipping symlink to an already visited directory",
+				zap.String("path", path),
+				zap.String("target", target))
+			return nil
+		}
+
+		// fn walks the link itself first so exclude patterns can skip it
+		if err := fn(path, info); err != nil {
+			if err == filepath.SkipDir {
+				return nil
+			}
+			return err
+		}
+		return u.walk(path, target, visited, func(p string, i os.FileInfo) error {
+			// The target directory was already reported as the link above
+			if p == path {
+				return nil
+			}
+			return fn(p, i)
+		})
+	})
+}
+
+// walkParallel is like walk but reads up to workers directories at the same time, which
+// helps on network filesystems where each directory listing is slow. Entries are
+// visited in no particular order; calls to fn are serialized, so fn needs no locking.
+func (u *Uploader) walkParallel(root, realRoot string, workers int, fn func(path string, info os.FileInfo) error) error {
+	type dir struct{ path, realPath string }
+
+	var (
+		mu       sync.Mutex
+		cond     = sync.NewCond(&mu)
+		fnMu     sync.Mutex
+		queue    = []dir{{root, realRoot}}
+		pending  = 1 // Directories queued or being read
+		visited  = map[string]bool{realRoot: true}
+		firstErr error
+	)
+
+	info, err := os.Stat(realRoot)
+	if err != nil {
+		return err
+	}
+	if err := fn(root, info); err != nil {
+		if err == filepath.SkipDir {
+			return nil
+		}
+		return err
+	}
+
+	visit := func(path string, info os.FileInfo) error {
+		fnMu.Lock()
+		defer fnMu.Unlock()
+		return fn(path, info)
+	}
+
+	// readDir visits the entries of d and returns the subdirectories to walk next
+	readDir := func(d dir) ([]dir, error) {
+		entries, err := os.ReadDir(d.realPath)
+		if err != nil {
+			if u.skipUnreadable(d.path, err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+
+		var subdirs []dir
+		for _, entry := range entries {
+			path := filepath.Join(d.path, entry.Name())
+			realPath := filepath.Join(d.realPath, entry.Name())
+
+			var info os.FileInfo
+			link := entry.Type()&fs.ModeSymlink != 0
+			if !link {
+				if info, err = entry.Info(); err != nil {
+					if u.skipUnreadable(path, err) {
+						continue
+					}
+					return nil, err
+				}
+			} else {
+				// Stat follows the link, so info describes the target
+				if info, err = os.Stat(realPath); err != nil {
+					u.logger.Debug("Skipping broken symlink", zap.String("path", path), zap.Error(err))
+					continue
+				}
+				if info.IsDir() {
+					if !u.config.FollowSymlinks {
+						u.logger.Debug("Skipping symlinked directory", zap.String("path", path))
+						continue
+					}
+					if realPath, err = filepath.EvalSymlinks(realPath); err != nil {
+						return nil, err
+					}
+				}
+			}
+
+			if !info.IsDir() {
+				if err := visit(path, info); err != nil {
+					return nil, err
+				}
+				continue
+			}
+
+			// As in walk, only links are checked; a real directory is always walked
+			mu.Lock()
+			seen := visited[realPath]
+			visited[realPath] = true
+			mu.Unlock()
+			if link && seen {
+				u.logger.Debug("Skipping symlink to an already visited directory",
+					zap.String("path", path),
+					zap.String("target", realPath))
+				continue
+			}
+
+			if err := visit(path, info); err != nil {
+				if err == filepath.SkipDir {
+					continue
+				}
+				return nil, err
+			}
+			subdirs = append(subdirs, dir{path, realPath})
+		}
+		return subdirs, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				mu.Lock()
+				for len(queue) == 0 && pending > 0 && firstErr == nil {
+					cond.Wait()
+				}
+				if pending == 0 || firstErr != nil {
+					mu.Unlock()
+					return
+				}
+				d := queue[len(queue)-1]
+				queue = queue[:len(queue)-1]
+				mu.Unlock()
+
+				subdirs, err := readDir(d)
+
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				queue = append(queue, subdirs...)
+				pending += len(subdirs) - 1
+				cond.Broadcast()
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	return firstErr
+}
+
+// sortUploadOrder sorts files in place for an UploadOrder other than UploadOrderNone.
+// Files of equal size keep their walk order.
+func sortUploadOrder(files []LocalFile, order string) {
+	switch order {
+	case UploadOrderLargestFirst:
+		sort.SliceStable(files, func(i, j int) bool { return files[i].Size > files[j].Size })
+	case UploadOrderSmallestFirst:
+		sort.SliceStable(files, func(i, j int) bool { return files[i].Size < files[j].Size })
+	case UploadOrderAlpha:
+		sort.SliceStable(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	}
+}
+
+// isSelected reports whether a relative path (slash-separated) would be picked up by FindFiles
+func (u *Uploader) isSelected(relPath string) (bool, error) {
+	// Directories at the depth limit are skipped, so files there are never found
+	if u.config.MaxDepth != nil && strings.Count(relPath, "/") > *u.config.MaxDepth {
+		return false, nil
+	}
+	// Excluded and hidden directories are never walked, so check every parent as well
+	for dir := path.Dir(relPath); dir != "."; dir = path.Dir(dir) {
+		if u.isHidden(path.Base(dir)) {
+			return false, nil
+		}
+		if excluded, err := u.isExcluded(dir, true); err != nil || excluded {
+			return false, err
+		}
+	}
+	if u.isHidden(path.Base(relPath)) {
+		return false, nil
+	}
+	if excluded, err := u.isExcluded(relPath, false); err != nil || excluded {
+		return false, err
+	}
+
+	patterns := u.config.IncludePatterns()
+	if len(patterns) == 0 {
+		return true, nil
+	}
+	for _, pattern := range patterns {
+		if matched, err := u.matchPattern(pattern, relPath); err != nil || matched {
+			return matched, err
+		}
+	}
+	return false, nil
+}
+
+// isHidden reports whether a file or directory name starts with "." and IncludeHidden
+// is false, so it is left out
+func (u *Uploader) isHidden(name string) bool {
+	return !aws.ToBool(u.config.IncludeHidden) && strings.HasPrefix(name, ".")
+}
+
+// isExcluded reports whether a relative path matches any exclude pattern or ignore rule,
+// or is a sidecar file
+func (u *Uploader) isExcluded(relPath string, isDir bool) (bool, error) {
+	if u.ignore != nil && u.ignore.ignored(relPath, isDir) {
+		return true, nil
+	}
+	if !isDir && u.isSidecar(relPath) {
+		return true, nil
+	}
+
+	for _, pattern := range u.config.ExcludePatterns {
+		matched, err := u.matchPattern(pattern, relPath)
+		if err != nil {
+			return false, err
+		}
+		if matched {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// matchPattern matches a glob pattern against a file. Patterns containing a path
+// separator or "**" are matched against the whole relative path (e.g. "photos/**/*.png");
+// other patterns are matched against the base name only (e.g. "*.jpg"). With
+// CaseInsensitivePatterns both are lowercased first.
+func (u *Uploader) matchPattern(pattern, relPath string) (bool, error) {
+	relPath = filepath.ToSlash(relPath)
+	if u.config.CaseInsensitivePatterns {
+		pattern, relPath = strings.ToLower(pattern), strings.ToLower(relPath)
+	}
+	if strings.Contains(pattern, "/") || strings.Contains(pattern, "**") {
+		return doublestar.Match(pattern, relPath)
+	}
+	return path.Match(pattern, path.Base(relPath))
+}
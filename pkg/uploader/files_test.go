@@ -0,0 +1,67 @@
+package uploader
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsSelectedHonoursMaxDepth(t *testing.T) {
+	depth := 1
+	u, _ := newTestUploader(t, t.TempDir(), func(cfg *Config) {
+		cfg.MaxDepth = &depth
+	})
+
+	tests := []struct {
+		relPath string
+		want    bool
+	}{
+		{"top.txt", true},
+		{"logs/app.log", true},
+		{"logs/2024/app.log", false},
+		{"logs/2024/01/app.log", false},
+	}
+	for _, tt := range tests {
+		got, err := u.isSelected(tt.relPath)
+		if err != nil {
+			t.Fatalf("isSelected(%q): %v", tt.relPath, err)
+		}
+		if got != tt.want {
+			t.Errorf("isSelected(%q) = %v, want %v", tt.relPath, got, tt.want)
+		}
+	}
+}
+
+func TestFindFilesNoMarkerAboveMaxDepth(t *testing.T) {
+	dir := t.TempDir()
+	// a/b is below the limit; a isn't empty, so it gets no marker. empty/ still does.
+	for _, sub := range []string{"a/b", "empty"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestFile(t, filepath.Join(dir, "a", "b"), "deep.txt", 10)
+
+	depth := 1
+	u, _ := newTestUploader(t, dir, func(cfg *Config) {
+		cfg.MaxDepth = &depth
+		cfg.CreateFolderMarkers = true
+	})
+	files, err := u.FindFiles()
+	if err != nil {
+		t.Fatalf("FindFiles: %v", err)
+	}
+
+	var markers []string
+	for _, file := range files {
+		if !file.Dir {
+			t.Errorf("found %s, which is below max_depth", file.Path)
+			continue
+		}
+		rel, _ := filepath.Rel(dir, file.Path)
+		markers = append(markers, rel)
+	}
+	if len(markers) != 1 || markers[0] != "empty" {
+		t.Errorf("folder markers for %v, want only empty", markers)
+	}
+}
@@ -0,0 +1,179 @@
+package uploader
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const defaultGzipExtension = ".gz"
+
+// compressedExtensions are formats that gain nothing from gzip, so they are never compressed
+var compressedExtensions = map[string]bool{
+	".gz": true, ".tgz": true, ".zip": true, ".bz2": true, ".xz": true, ".zst": true, ".7z": true, ".rar": true,
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".avif": true,
+	".mp3": true, ".mp4": true, ".mkv": true, ".mov": true, ".webm": true,
+}
+
+// shouldGzip reports whether a file (slash-separated path relative to its source) is compressed before upload
+func (u *Uploader) shouldGzip(relPath string) (bool, error) {
+	if !u.config.Gzip || compressedExtensions[strings.ToLower(path.Ext(relPath))] {
+		return false, nil
+	}
+	if len(u.config.GzipPatterns) == 0 {
+		return true, nil
+	}
+	for _, pattern := range u.config.GzipPatterns {
+		if matched, err := u.matchPattern(pattern, relPath); err != nil || matched {
+			return matched, err
+		}
+	}
+	return false, nil
+}
+
+// uploadGzip compresses file while uploading it and returns the compressed size and ETag.
+// The caller sets input's ContentEncoding.
+// Compressed data is buffered one part at a time: output that fits in a single part is
+// sent with PutObject, anything larger with multipart, PartConcurrency parts at once
+// while the next one is compressed.
+func (u *Uploader) uploadGzip(ctx context.Context, file io.ReaderAt, input *s3.PutObjectInput, size int64) (int64, string, error) {
+	s3Key := aws.ToString(input.Key)
+
+	pr, pw := io.Pipe()
+	go func() {
+		gz := gzip.NewWriter(pw)
+		_, err := io.Copy(gz, io.NewSectionReader(file, 0, size))
+		if err == nil {
+			err = gz.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	// Unblocks the compressor if the upload stops early
+	defer pr.Close()
+
+	// Most files are far smaller than a part, so the first buffer is only as large as
+	// their compressed output can get
+	var buf []byte
+	if bound := gzipBound(size); bound < u.config.PartSize {
+		buf = make([]byte, bound)
+	} else {
+		buf = u.partBuffer()
+	}
+	n, err := io.ReadFull(pr, buf)
+	if err == nil && int64(len(buf)) < u.config.PartSize {
+		// The output outgrew gzipBound; widen the buffer rather than send a short first part
+		full := u.partBuffer()
+		copy(full, buf)
+		var more int
+		more, err = io.ReadFull(pr, full[n:])
+		buf, n = full, n+more
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		etag, err := u.putBuffer(ctx, input, buf[:n])
+		u.releasePartBuffer(buf)
+		return int64(n), etag, err
+	}
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to compress file: %w", err)
+	}
+
+	uploadID, err := u.createMultipart(ctx, input)
+	if err != nil {
+		u.releasePartBuffer(buf)
+		return 0, "", err
+	}
+
+	group := u.newPartGroup(ctx, s3Key, uploadID)
+	var compressed int64
+	for partNumber := int32(1); n > 0; partNumber++ {
+		if int64(partNumber) > maxParts {
+			u.releasePartBuffer(buf)
+			group.wait()
+			u.abortMultipart(s3Key, uploadID)
+			return 0, "", fmt.Errorf("compressed file needs more than %d parts; increase part_size", maxParts)
+		}
+
+		// The buffer goes back to the pool once its part is uploaded
+		part := buf[:n]
+		if !group.add(partNumber, io.NewSectionReader(bytes.NewReader(part), 0, int64(n)), func() { u.releasePartBuffer(part) }) {
+			buf = nil
+			break
+		}
+		compressed += int64(n)
+
+		buf = u.partBuffer()
+		n, err = io.ReadFull(pr, buf)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			u.releasePartBuffer(buf)
+			group.wait()
+			u.abortMultipart(s3Key, uploadID)
+			return 0, "", fmt.Errorf("failed to compress file: %w", err)
+		}
+	}
+	u.releasePartBuffer(buf)
+
+	parts, err := group.wait()
+	if err != nil {
+		u.abortMultipart(s3Key, uploadID)
+		return 0, "", err
+	}
+	etag, err := u.completeMultipart(ctx, s3Key, uploadID, parts)
+	return compressed, etag, err
+}
+
+// gzipBound is the most gzip can output for n bytes of input. Incompressible data is
+// stored as is, in blocks with a 5-byte header, followed by an empty final block, and
+// gzip adds an 18-byte header and trailer.
+func gzipBound(n int64) int64 {
+	return n + (n/16384+2)*5 + 18
+}
+
+// partBuffer returns a PartSize buffer for compressed data, reusing a released one if possible
+func (u *Uploader) partBuffer() []byte {
+	if buf, ok := u.partBuffers.Get().(*[]byte); ok {
+		return *buf
+	}
+	return make([]byte, u.config.PartSize)
+}
+
+// releasePartBuffer returns a buffer from partBuffer to the pool. Smaller buffers, and
+// nil, are dropped.
+func (u *Uploader) releasePartBuffer(buf []byte) {
+	if int64(cap(buf)) != u.config.PartSize {
+		return
+	}
+	buf = buf[:cap(buf)]
+	u.partBuffers.Put(&buf)
+}
+
+// putBuffer uploads data held in memory with a single PutObject and returns the ETag
+func (u *Uploader) putBuffer(ctx context.Context, input *s3.PutObjectInput, data []byte) (string, error) {
+	if u.config.VerifyIntegrity {
+		checksum, err := contentMD5(bytes.NewReader(data))
+		if err != nil {
+			return "", err
+		}
+		input.ContentMD5 = aws.String(checksum)
+	}
+
+	input.ContentLength = aws.Int64(int64(len(data)))
+	var out *s3.PutObjectOutput
+	err := u.withRetry(ctx, "PutObject", aws.ToString(input.Key), func() error {
+		input.Body = u.uploadBody(ctx, bytes.NewReader(data))
+		var err error
+		out, err = u.client().PutObject(ctx, input)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to upload file: %w", err)
+	}
+	return trimETag(out.ETag), nil
+}
@@ -0,0 +1,122 @@
+package uploader
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// gunzip decompresses data stored by uploadGzip
+func gunzip(t *testing.T, data []byte) []byte {
+	t.Helper()
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("stored object is not gzip: %v", err)
+	}
+	out, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("stored object is not valid gzip: %v", err)
+	}
+	return out
+}
+
+func TestUploadGzipSinglePart(t *testing.T) {
+	dir := t.TempDir()
+	path, data := writeTestFile(t, dir, "app.log", 64*1024)
+	u, client := newTestUploader(t, dir, func(cfg *Config) {
+		cfg.Gzip = true
+	})
+
+	if err := u.UploadFile(context.Background(), path); err != nil {
+		t.Fatalf("UploadFile: %v", err)
+	}
+
+	stored, ok := client.object("backup/app.log.gz")
+	if !ok {
+		t.Fatal("object backup/app.log.gz was not stored")
+	}
+	if !bytes.Equal(gunzip(t, stored), data) {
+		t.Error("decompressed object differs from the file")
+	}
+	if n := client.callCount("CreateMultipartUpload"); n != 0 {
+		t.Errorf("compressed small file started %d multipart uploads", n)
+	}
+}
+
+func TestUploadGzipMultipart(t *testing.T) {
+	dir := t.TempDir()
+	// Random data doesn't compress, so the output needs several parts
+	data := make([]byte, 2*minPartSize+1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	path := filepath.Join(dir, "random.bin")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	u, client := newTestUploader(t, dir, func(cfg *Config) {
+		cfg.Gzip = true
+		cfg.PartSize = minPartSize
+		cfg.PartConcurrency = 2
+	})
+
+	if err := u.UploadFile(context.Background(), path); err != nil {
+		t.Fatalf("UploadFile: %v", err)
+	}
+
+	stored, ok := client.object("backup/random.bin.gz")
+	if !ok {
+		t.Fatal("object backup/random.bin.gz was not stored")
+	}
+	if !bytes.Equal(gunzip(t, stored), data) {
+		t.Error("decompressed object differs from the file")
+	}
+	if n := client.callCount("UploadPart"); n != 3 {
+		t.Errorf("uploaded %d parts, want 3", n)
+	}
+}
+
+func TestGzipBound(t *testing.T) {
+	for _, size := range []int{0, 1, 1000, 16384, 100000, 1 << 20} {
+		data := make([]byte, size)
+		rand.New(rand.NewSource(int64(size))).Read(data)
+
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(data)
+		gz.Close()
+		if bound := gzipBound(int64(size)); int64(buf.Len()) > bound {
+			t.Errorf("gzip output for %d random bytes is %d bytes, more than gzipBound's %d", size, buf.Len(), bound)
+		}
+	}
+}
+
+func TestUploadGzipDuplicateKeepsEncoding(t *testing.T) {
+	dir := t.TempDir()
+	_, data := writeTestFile(t, dir, "a.log", 64*1024)
+	if err := os.WriteFile(filepath.Join(dir, "b.log"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	u, client := newTestUploader(t, dir, func(cfg *Config) {
+		cfg.Gzip = true
+		cfg.DedupByHash = true
+	})
+
+	for _, name := range []string{"a.log", "b.log"} {
+		if err := u.UploadFile(context.Background(), filepath.Join(dir, name)); err != nil {
+			t.Fatalf("UploadFile(%s): %v", name, err)
+		}
+	}
+
+	if n := client.callCount("CopyObject"); n != 1 {
+		t.Fatalf("CopyObject was called %d times, want 1 for the duplicate", n)
+	}
+	for _, key := range []string{"backup/a.log.gz", "backup/b.log.gz"} {
+		if got := client.contentEncoding(key); got != "gzip" {
+			t.Errorf("%s has Content-Encoding %q, want gzip", key, got)
+		}
+	}
+}
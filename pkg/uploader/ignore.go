@@ -0,0 +1,81 @@
+package uploader
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+// ignoreRule is a single pattern from a .gitignore-style file
+type ignoreRule struct {
+	pattern string // doublestar pattern matched against the slash-separated relative path
+	negate  bool   // "!pattern" re-includes paths excluded by earlier rules
+	dirOnly bool   // "pattern/" only matches directories
+}
+
+// ignoreMatcher applies .gitignore-style rules, where the last matching rule wins
+type ignoreMatcher struct {
+	rules []ignoreRule
+}
+
+// loadIgnoreFile parses a .gitignore-style file
+func loadIgnoreFile(ignorePath string) (*ignoreMatcher, error) {
+	data, err := os.ReadFile(ignorePath)
+	if err != nil {
+		return nil, err
+	}
+
+	matcher := &ignoreMatcher{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, " \r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var rule ignoreRule
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\#`) || strings.HasPrefix(line, `\!`) {
+			line = line[1:]
+		}
+
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+
+		// A pattern with a slash is anchored to the root; otherwise it matches at any depth
+		if strings.Contains(line, "/") {
+			rule.pattern = strings.TrimPrefix(line, "/")
+		} else {
+			rule.pattern = "**/" + line
+		}
+
+		if line == "" || !doublestar.ValidatePattern(rule.pattern) {
+			return nil, fmt.Errorf("invalid pattern in %s: %q", ignorePath, line)
+		}
+		matcher.rules = append(matcher.rules, rule)
+	}
+
+	return matcher, nil
+}
+
+// ignored reports whether a relative path is ignored by the rules
+func (m *ignoreMatcher) ignored(relPath string, isDir bool) bool {
+	relPath = filepath.ToSlash(relPath)
+
+	ignored := false
+	for _, rule := range m.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if matched, _ := doublestar.Match(rule.pattern, relPath); matched {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
@@ -0,0 +1,186 @@
+package uploader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"unicode"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+)
+
+// keyData holds the variables available to KeyTemplate
+type keyData struct {
+	RelPath  string // Path relative to its source with forward slashes, e.g. "logs/app.log"
+	Dir      string // Directory part of RelPath, "." for files at the top level
+	Base     string // File name, e.g. "app.log"
+	Ext      string // Extension including the dot, e.g. ".log"
+	Date     string // Run date as "2006/01/02"
+	UnixTime int64  // Run start time in seconds since the epoch
+	Hostname string
+	RunID    string
+}
+
+// parseKeyTemplate parses text and executes it once on sample data so references
+// to unknown variables are reported up front rather than for every file
+func parseKeyTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("key").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	sample := keyData{RelPath: "dir/file.txt", Dir: "dir", Base: "file.txt", Ext: ".txt"}
+	if err := tmpl.Execute(&strings.Builder{}, sample); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// templateKey renders KeyTemplate for a file. The result is relative to S3Prefix.
+func (u *Uploader) templateKey(relPath string) (string, error) {
+	hostname, _ := os.Hostname()
+	data := keyData{
+		RelPath:  relPath,
+		Dir:      path.Dir(relPath),
+		Base:     path.Base(relPath),
+		Ext:      path.Ext(relPath),
+		Date:     u.startTime.UTC().Format("2006/01/02"),
+		UnixTime: u.startTime.Unix(),
+		Hostname: hostname,
+		RunID:    u.runID,
+	}
+
+	var key strings.Builder
+	if err := u.keyTemplate.Execute(&key, data); err != nil {
+		return "", fmt.Errorf("failed to render key template: %w", err)
+	}
+	return strings.TrimPrefix(key.String(), "/"), nil
+}
+
+// stripPrefix returns StripPrefix as it appears at the start of a relative path, e.g.
+// "exports/2024/", or "" when unset
+func (u *Uploader) stripPrefix() string {
+	prefix := strings.Trim(filepath.ToSlash(u.config.StripPrefix), "/")
+	if prefix == "" {
+		return ""
+	}
+	return path.Clean(prefix) + "/"
+}
+
+// stripRel removes StripPrefix from a relative path (slash-separated). It reports false,
+// leaving the path as is, when the path doesn't start with the prefix.
+func (u *Uploader) stripRel(relPath string) (string, bool) {
+	prefix := u.stripPrefix()
+	if prefix == "" {
+		return relPath, true
+	}
+	if !strings.HasPrefix(relPath, prefix) {
+		return relPath, false
+	}
+	return strings.TrimPrefix(relPath, prefix), true
+}
+
+// maxKeyBytes is the longest key S3 accepts, in bytes of UTF-8
+const maxKeyBytes = 1024
+
+// keyAvoidChars are characters AWS advises against in keys because URLs and some tools mishandle them
+const keyAvoidChars = "\\{}^%`[]\"<>~#|"
+
+// sanitizeKeyPart replaces control characters, invalid UTF-8 and keyAvoidChars with "_"
+func sanitizeKeyPart(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		if r == utf8.RuneError {
+			if _, size := utf8.DecodeRuneInString(s[i:]); size == 1 {
+				b.WriteByte('_')
+				continue
+			}
+		}
+		if unicode.IsControl(r) || strings.ContainsRune(keyAvoidChars, r) {
+			b.WriteByte('_')
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// shortenKey cuts a key to maxKeyBytes, keeping its extension. A hash of the full key
+// is added in place of the cut text so keys that only differ near the end stay distinct.
+func shortenKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	ext := path.Ext(key)
+	if len(ext) > 16 {
+		ext = ""
+	}
+	suffix := "-" + hex.EncodeToString(sum[:4]) + ext
+
+	cut := maxKeyBytes - len(suffix)
+	// Don't split a multi-byte character
+	for cut > 0 && !utf8.RuneStart(key[cut]) {
+		cut--
+	}
+	return key[:cut] + suffix
+}
+
+// checkKey returns an error for a key S3 would reject and a warning for one that
+// is accepted but contains characters that cause trouble elsewhere
+func checkKey(key string) (warning string, err error) {
+	if len(key) > maxKeyBytes {
+		return "", fmt.Errorf("key is %d bytes but S3 allows at most %d; shorten the path or set sanitize_keys: %s", len(key), maxKeyBytes, key)
+	}
+	if !utf8.ValidString(key) {
+		return "", fmt.Errorf("key is not valid UTF-8; rename the file or set sanitize_keys: %q", key)
+	}
+	for _, r := range key {
+		if unicode.IsControl(r) {
+			return "key contains control characters", nil
+		}
+	}
+	if strings.ContainsAny(key, keyAvoidChars) {
+		return "key contains characters that URLs and some tools mishandle", nil
+	}
+	return "", nil
+}
+
+// checkKeyCollisions returns an error if two local files map to the same S3 key,
+// which can happen with Flatten, a KeyTemplate that drops part of the path, or sources
+// sharing a prefix. Files whose paths differ only in case, which LowercaseKeys maps to
+// one key, are only warned about; one of them overwrites the other.
+func (u *Uploader) checkKeyCollisions(files []LocalFile) error {
+	seen := make(map[string]string, len(files))
+	var collisions []string
+	for _, file := range files {
+		s3Key, err := u.s3Key(file.Path)
+		if err != nil {
+			return err
+		}
+		if other, ok := seen[s3Key]; ok {
+			if u.config.LowercaseKeys && strings.EqualFold(other, file.Path) {
+				u.logger.Warn("Files differ only in case and will overwrite each other in S3",
+					zap.String("file", other),
+					zap.String("other_file", file.Path),
+					zap.String("s3_key", s3Key))
+				continue
+			}
+			collisions = append(collisions, fmt.Sprintf("%s and %s both map to %s", other, file.Path, s3Key))
+			continue
+		}
+		seen[s3Key] = file.Path
+	}
+
+	if len(collisions) == 0 {
+		return nil
+	}
+	sort.Strings(collisions)
+	for _, collision := range collisions {
+		u.logger.Error("S3 key collision", zap.String("detail", collision))
+	}
+	return fmt.Errorf("%d files would overwrite each other in S3: %s", len(collisions), collisions[0])
+}
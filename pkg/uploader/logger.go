@@ -0,0 +1,81 @@
+package uploader
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mattn/go-isatty"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Values accepted by LogFormat
+const (
+	logFormatJSON    = "json"
+	logFormatConsole = "console"
+)
+
+// isTerminal reports whether f is an interactive terminal rather than a pipe or file
+func isTerminal(f *os.File) bool {
+	return isatty.IsTerminal(f.Fd()) || isatty.IsCygwinTerminal(f.Fd())
+}
+
+// createLogger creates a new logger with the specified log level and format. An empty
+// format picks human-readable console output when stderr is a terminal and JSON otherwise.
+// With logFile, every entry is also appended to that file as JSON.
+func createLogger(level, format, logFile string) (*zap.Logger, error) {
+	terminal := isTerminal(os.Stderr)
+	if format == "" {
+		format = logFormatJSON
+		if terminal {
+			format = logFormatConsole
+		}
+	}
+
+	// Logger configuration
+	var config zap.Config
+	if format == logFormatConsole {
+		config = zap.NewDevelopmentConfig()
+		// Development mode would add stack traces to warnings and panic on DPanic
+		config.Development = false
+		if terminal {
+			config.EncoderConfig.EncodeLevel = zapcore.CapitalColorLevelEncoder
+		}
+	} else {
+		config = zap.NewProductionConfig()
+	}
+
+	// Set log level
+	switch strings.ToLower(level) {
+	case "debug":
+		config.Level = zap.NewAtomicLevelAt(zapcore.DebugLevel)
+	case "info":
+		config.Level = zap.NewAtomicLevelAt(zapcore.InfoLevel)
+	case "warn":
+		config.Level = zap.NewAtomicLevelAt(zapcore.WarnLevel)
+	case "error":
+		config.Level = zap.NewAtomicLevelAt(zapcore.ErrorLevel)
+	default:
+		config.Level = zap.NewAtomicLevelAt(zapcore.InfoLevel)
+	}
+
+	logger, err := config.Build()
+	if err != nil || logFile == "" {
+		return logger, err
+	}
+
+	file, err := os.OpenFile(logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file: %w", err)
+	}
+
+	// The file always gets JSON with readable timestamps, whatever stderr shows
+	encoderConfig := zap.NewProductionEncoderConfig()
+	encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	fileCore := zapcore.NewCore(zapcore.NewJSONEncoder(encoderConfig), zapcore.AddSync(file), config.Level)
+
+	return logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return zapcore.NewTee(core, fileCore)
+	})), nil
+}
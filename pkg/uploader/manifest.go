@@ -0,0 +1,131 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"go.uber.org/zap"
+)
+
+const defaultManifestName = "manifest.json"
+
+// Manifest lists the objects a run uploaded or found already up to date
+type Manifest struct {
+	RunID       string          `json:"run_id"`
+	Bucket      string          `json:"bucket"`
+	GeneratedAt time.Time       `json:"generated_at"`
+	Objects     []ManifestEntry `json:"objects"`
+}
+
+// ManifestEntry is a single object in a Manifest. ContentType is empty for files
+// skipped by SkipExisting, since their content type is not listed by S3.
+type ManifestEntry struct {
+	Key         string `json:"key"`
+	Size        int64  `json:"size"`
+	ETag        string `json:"etag"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// manifest collects entries from all workers. A nil manifest ignores them.
+type manifest struct {
+	mu      sync.Mutex
+	entries []ManifestEntry
+}
+
+// add records an object
+func (m *manifest) add(entry ManifestEntry) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = append(m.entries, entry)
+}
+
+// manifestKey returns ManifestKey, or manifest.json under S3Prefix
+func (u *Uploader) manifestKey() string {
+	if u.config.ManifestKey != "" {
+		return u.config.ManifestKey
+	}
+	return path.Join(strings.Trim(filepath.ToSlash(u.config.S3Prefix), "/"), defaultManifestName)
+}
+
+// uploadManifest encodes the collected entries, sorted by key, and uploads them to manifestKey
+func (u *Uploader) uploadManifest(ctx context.Context) error {
+	key := u.manifestKey()
+	if u.config.DryRun {
+		u.logger.Info("Dry run: would upload manifest", zap.String("s3_key", key))
+		return nil
+	}
+
+	u.manifest.mu.Lock()
+	entries := append([]ManifestEntry(nil), u.manifest.entries...)
+	u.manifest.mu.Unlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+
+	var data []byte
+	var contentType string
+	if strings.EqualFold(path.Ext(key), ".csv") {
+		var buf bytes.Buffer
+		w := csv.NewWriter(&buf)
+		w.Write([]string{"key", "size", "etag", "content_type"})
+		for _, entry := range entries {
+			w.Write([]string{entry.Key, strconv.FormatInt(entry.Size, 10), entry.ETag, entry.ContentType})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return fmt.Errorf("failed to encode manifest: %w", err)
+		}
+		data, contentType = buf.Bytes(), "text/csv"
+	} else {
+		encoded, err := json.MarshalIndent(&Manifest{
+			RunID:       u.runID,
+			Bucket:      u.config.BucketName,
+			GeneratedAt: time.Now().UTC(),
+			Objects:     entries,
+		}, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to encode manifest: %w", err)
+		}
+		data, contentType = append(encoded, '\n'), "application/json"
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:        aws.String(u.config.BucketName),
+		RequestPayer:  u.requestPayer(),
+		Key:           aws.String(key),
+		ContentType:   aws.String(contentType),
+		ContentLength: aws.Int64(int64(len(data))),
+	}
+	if u.config.ServerSideEncryption != "" {
+		input.ServerSideEncryption = types.ServerSideEncryption(u.config.ServerSideEncryption)
+	}
+	if u.config.KMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(u.config.KMSKeyID)
+	}
+
+	err := u.withRetry(ctx, "PutObject", key, func() error {
+		input.Body = bytes.NewReader(data)
+		_, err := u.client().PutObject(ctx, input)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload manifest: %w", err)
+	}
+
+	u.logger.Info("Uploaded manifest", zap.String("s3_key", key), zap.Int("objects", len(entries)))
+	return nil
+}
@@ -0,0 +1,127 @@
+package uploader
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsNamespace prefixes every exported metric, e.g. s3_uploader_bytes_uploaded_total
+const metricsNamespace = "s3_uploader"
+
+// metrics holds the Prometheus collectors updated by workers when MetricsAddr is set.
+// All methods are safe to call on a nil *metrics, which records nothing.
+type metrics struct {
+	registry *prometheus.Registry
+
+	filesUploaded prometheus.Counter
+	filesSkipped  prometheus.Counter
+	filesFailed   prometheus.Counter
+	bytesUploaded prometheus.Counter
+	inFlight      prometheus.Gauge
+
+	// Throughput is recomputed on scrape from the bytes uploaded since the last sample
+	mu         sync.Mutex
+	bytes      float64
+	lastBytes  float64
+	lastSample time.Time
+	throughput float64
+}
+
+// newMetrics creates the collectors in their own registry, so embedding the package
+// doesn't clash with metrics registered by the host program
+func newMetrics(bucket string) *metrics {
+	labels := prometheus.Labels{"bucket": bucket}
+	m := &metrics{
+		registry:   prometheus.NewRegistry(),
+		lastSample: time.Now(),
+		filesUploaded: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Name: "files_uploaded_total", ConstLabels: labels,
+			Help: "Files uploaded successfully.",
+		}),
+		filesSkipped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Name: "files_skipped_total", ConstLabels: labels,
+			Help: "Files skipped because the object was already up to date.",
+		}),
+		filesFailed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Name: "files_failed_total", ConstLabels: labels,
+			Help: "File uploads that failed, counting each attempt of a run retry.",
+		}),
+		bytesUploaded: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Name: "bytes_uploaded_total", ConstLabels: labels,
+			Help: "Bytes of files uploaded successfully.",
+		}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace, Name: "workers_in_flight", ConstLabels: labels,
+			Help: "Workers currently uploading a file.",
+		}),
+	}
+	throughput := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace, Name: "throughput_bytes_per_second", ConstLabels: labels,
+		Help: "Upload rate since the previous scrape.",
+	}, m.sampleThroughput)
+
+	m.registry.MustRegister(
+		m.filesUploaded, m.filesSkipped, m.filesFailed, m.bytesUploaded, m.inFlight, throughput,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// startFile records a worker starting on a file
+func (m *metrics) startFile() {
+	if m == nil {
+		return
+	}
+	m.inFlight.Inc()
+}
+
+// finishFile records the outcome of a file started with startFile
+func (m *metrics) finishFile(size int64, err error) {
+	if m == nil {
+		return
+	}
+	m.inFlight.Dec()
+
+	switch {
+	case errors.Is(err, ErrSkipped):
+		m.filesSkipped.Inc()
+	case err != nil:
+		m.filesFailed.Inc()
+	default:
+		m.filesUploaded.Inc()
+		m.bytesUploaded.Add(float64(size))
+		m.mu.Lock()
+		m.bytes += float64(size)
+		m.mu.Unlock()
+	}
+}
+
+// sampleThroughput returns the rate since the previous sample. Scrapes less than a
+// second apart reuse the last value so the rate isn't computed over a tiny window.
+func (m *metrics) sampleThroughput() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if elapsed := now.Sub(m.lastSample); elapsed >= time.Second {
+		m.throughput = (m.bytes - m.lastBytes) / elapsed.Seconds()
+		m.lastBytes, m.lastSample = m.bytes, now
+	}
+	return m.throughput
+}
+
+// MetricsHandler returns an HTTP handler serving the uploader's Prometheus metrics,
+// or nil when MetricsAddr is not set
+func (u *Uploader) MetricsHandler() http.Handler {
+	if u.metrics == nil {
+		return nil
+	}
+	return promhttp.HandlerFor(u.metrics.registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,287 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// objectDeleter is implemented by *s3.Client. It isn't part of S3API so injected clients
+// only need it for move mode with DeleteSource.
+type objectDeleter interface {
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+}
+
+// movePrefix normalizes a prefix for listing, e.g. "incoming/" for "/incoming"
+func movePrefix(prefix string) string {
+	prefix = strings.Trim(filepath.ToSlash(prefix), "/")
+	if prefix == "" {
+		return ""
+	}
+	return path.Clean(prefix) + "/"
+}
+
+// validateMove checks the settings of ModeMove
+func validateMove(cfg *Config) error {
+	if cfg.MoveSourcePrefix == "" {
+		return &ConfigError{Field: "move_source_prefix", Message: "is required in move mode"}
+	}
+	// Copies landing under the source prefix would be listed and moved again
+	if src, dst := movePrefix(cfg.MoveSourcePrefix), movePrefix(cfg.S3Prefix); strings.HasPrefix(dst, src) {
+		return &ConfigError{Field: "s3_prefix", Message: fmt.Sprintf("must not be inside move_source_prefix %q in move mode: %q", cfg.MoveSourcePrefix, cfg.S3Prefix)}
+	}
+	if len(cfg.Sources) > 0 || cfg.Mirror || cfg.FileList != "" || cfg.StateFile != "" || cfg.DeleteAfterUpload ||
+		cfg.GenerateManifest || cfg.Gzip || cfg.SkipExisting || cfg.DedupByHash {
+		return &ConfigError{Field: "mode", Message: "move cannot be combined with sources, mirror, file_list, state_file, delete_after_upload, generate_manifest, gzip, skip_existing or dedup_by_hash"}
+	}
+	return nil
+}
+
+// move runs UploadWithContext in ModeMove. Objects under MoveSourcePrefix are copied
+// server-side by the worker pool to the key an upload of the same relative path would
+// get, and deleted from the source afterwards when DeleteSource is set.
+func (u *Uploader) move(ctx context.Context) error {
+	if _, ok := u.client().(objectCopier); !ok {
+		return errors.New("move mode needs an S3 client that implements CopyObject")
+	}
+	if _, ok := u.client().(objectDeleter); u.config.DeleteSource && !ok {
+		return errors.New("delete_source needs an S3 client that implements DeleteObject")
+	}
+	srcPrefix := movePrefix(u.config.MoveSourcePrefix)
+
+	u.logger.Info("Starting move",
+		zap.String("bucket", u.config.BucketName),
+		zap.String("source_prefix", srcPrefix),
+		zap.String("prefix", u.config.S3Prefix),
+		zap.Bool("delete_source", u.config.DeleteSource),
+		zap.String("region", u.config.Region),
+		zap.String("run_id", u.runID))
+	if !u.config.DeleteSource {
+		u.logger.Warn("delete_source is not set, so objects are copied and the originals are kept")
+	}
+
+	if !u.config.DryRun {
+		if err := u.checkBucket(ctx); err != nil {
+			return err
+		}
+		if u.config.ObjectLockMode != "" {
+			u.checkObjectLock(ctx)
+		}
+	}
+
+	// Keys that are rewritten could collide, and a collision must be caught before
+	// anything is copied, so then the whole listing is read first
+	checkCollisions := u.config.Flatten || u.keyTemplate != nil || u.config.LowercaseKeys || u.config.SanitizeKeys
+	var jobs []LocalFile
+	if checkCollisions {
+		destinations := make(map[string]string)
+		err := u.listMoves(ctx, srcPrefix, func(job LocalFile) error {
+			if other, ok := destinations[job.Path]; ok {
+				return fmt.Errorf("objects %q and %q would both be moved to %q", other, job.Key, job.Path)
+			}
+			destinations[job.Path] = job.Key
+			jobs = append(jobs, job)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	prog := u.startProgress()
+	start := time.Now()
+
+	var totalFiles int
+	var totalSize int64
+	var stats runStats
+	listErr := u.runPass(ctx, prog, &stats, func(send func(LocalFile) error) error {
+		found := func(job LocalFile) error {
+			totalFiles++
+			totalSize += job.Size
+			prog.addTotal(job.Size)
+			return send(job)
+		}
+
+		var err error
+		if checkCollisions {
+			for _, job := range jobs {
+				if err = found(job); err != nil {
+					break
+				}
+			}
+			jobs = nil
+		} else {
+			err = u.listMoves(ctx, srcPrefix, found)
+		}
+		if err == nil {
+			u.logger.Info("Found objects to move",
+				zap.Int("count", totalFiles),
+				zap.Int64("total_bytes", totalSize))
+		}
+		return err
+	})
+
+	if listErr == nil {
+		u.retryFailed(ctx, prog, &stats)
+	}
+
+	prog.finish()
+
+	if listErr != nil && ctx.Err() == nil {
+		return fmt.Errorf("failed to list objects: %w", listErr)
+	}
+
+	return u.finishObjectRun(ctx, "Move", &stats, totalFiles, start)
+}
+
+// listMoves calls found with a job for every object under srcPrefix. Each job's Key is
+// the object to move and its Path the destination key.
+func (u *Uploader) listMoves(ctx context.Context, srcPrefix string, found func(LocalFile) error) error {
+	paginator := s3.NewListObjectsV2Paginator(u.client(), &s3.ListObjectsV2Input{
+		Bucket:       aws.String(u.config.BucketName),
+		RequestPayer: u.requestPayer(),
+		Prefix:       aws.String(srcPrefix),
+	})
+	for paginator.HasMorePages() {
+		if err := u.requests.wait(ctx); err != nil {
+			return err
+		}
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list objects: %w", err)
+		}
+		for _, obj := range page.Contents {
+			key := aws.ToString(obj.Key)
+			rel := strings.TrimPrefix(key, srcPrefix)
+			// Folder markers have nothing to move
+			if rel == "" || strings.HasSuffix(rel, "/") {
+				continue
+			}
+			dest, err := u.keyFor(u.config.S3Prefix, rel)
+			if err != nil {
+				return err
+			}
+			dest = filepath.ToSlash(dest)
+			if u.config.SanitizeKeys && len(dest) > maxKeyBytes {
+				dest = shortenKey(dest)
+			}
+			job := LocalFile{
+				Path:         dest,
+				Size:         aws.ToInt64(obj.Size),
+				ModTime:      aws.ToTime(obj.LastModified),
+				Key:          key,
+				storageClass: string(obj.StorageClass),
+			}
+			if err := found(job); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// moveObject moves a single object in its own span and returns its size and the ETag
+// of the copy
+func (u *Uploader) moveObject(ctx context.Context, job LocalFile) (int64, string, error) {
+	ctx, span := u.tracer.Start(ctx, "moveObject", trace.WithAttributes(
+		attribute.String("s3.bucket", u.config.BucketName),
+		attribute.String("s3.source_key", job.Key),
+		attribute.String("s3.key", job.Path),
+		attribute.Int64("file.size", job.Size)))
+	etag, err := u.relocateObject(ctx, job)
+	endSpan(span, err)
+	return job.Size, etag, err
+}
+
+// relocateObject does the work of moveObject. The copy keeps the object's metadata,
+// tags and storage class; ACL and encryption come from the config since S3 doesn't
+// carry them over.
+func (u *Uploader) relocateObject(ctx context.Context, job LocalFile) (string, error) {
+	if u.fileTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, u.fileTimeout)
+		defer cancel()
+	}
+
+	if job.Size > maxCopySize {
+		return "", errors.New("object is larger than 5 GB, which CopyObject can't copy in one request")
+	}
+
+	if u.config.DryRun {
+		u.logger.Info("Dry run: would move object",
+			zap.String("s3_key", job.Key),
+			zap.String("destination", job.Path),
+			zap.Int64("size", job.Size))
+		return "", nil
+	}
+
+	input := &s3.CopyObjectInput{
+		Bucket:       aws.String(u.config.BucketName),
+		RequestPayer: u.requestPayer(),
+		Key:          aws.String(job.Path),
+		CopySource:   aws.String(u.config.BucketName + "/" + (&url.URL{Path: job.Key}).EscapedPath()),
+		StorageClass: types.StorageClass(job.storageClass),
+	}
+	if u.config.StorageClass != "" {
+		input.StorageClass = types.StorageClass(u.config.StorageClass)
+	}
+	if u.config.ACL != "" {
+		input.ACL = types.ObjectCannedACL(u.config.ACL)
+	}
+	if u.config.ServerSideEncryption != "" {
+		input.ServerSideEncryption = types.ServerSideEncryption(u.config.ServerSideEncryption)
+	}
+	if u.config.KMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(u.config.KMSKeyID)
+	}
+	if u.config.ObjectLockMode != "" {
+		input.ObjectLockMode = types.ObjectLockMode(u.config.ObjectLockMode)
+		input.ObjectLockRetainUntilDate = aws.Time(u.lockRetainUntil())
+	}
+
+	// move checked that the client has CopyObject before any job was started
+	copier := u.client().(objectCopier)
+	var copied *s3.CopyObjectOutput
+	err := u.withRetry(ctx, "CopyObject", job.Path, func() error {
+		var err error
+		copied, err = copier.CopyObject(ctx, input)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to copy object: %w", err)
+	}
+	var etag string
+	if copied.CopyObjectResult != nil {
+		etag = trimETag(copied.CopyObjectResult.ETag)
+	}
+
+	if !u.config.DeleteSource {
+		return etag, nil
+	}
+	// move checked that the client has DeleteObject before any job was started
+	deleter := u.client().(objectDeleter)
+	err = u.withRetry(ctx, "DeleteObject", job.Key, func() error {
+		_, err := deleter.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket:       aws.String(u.config.BucketName),
+			RequestPayer: u.requestPayer(),
+			Key:          aws.String(job.Key),
+		})
+		return err
+	})
+	if err != nil {
+		return etag, fmt.Errorf("copied to %s but failed to delete the source: %w", job.Path, err)
+	}
+	return etag, nil
+}
@@ -0,0 +1,36 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestMoveDeletesSource(t *testing.T) {
+	u, client := newTestUploader(t, "", func(cfg *Config) {
+		cfg.LocalPath = ""
+		cfg.Mode = ModeMove
+		cfg.MoveSourcePrefix = "incoming"
+		cfg.DeleteSource = true
+	})
+	client.objects["incoming/a.txt"] = []byte("a")
+	client.objects["incoming/logs/b.txt"] = []byte("b")
+
+	if err := u.UploadWithContext(context.Background()); err != nil {
+		t.Fatalf("move: %v", err)
+	}
+
+	for key, want := range map[string][]byte{"backup/a.txt": []byte("a"), "backup/logs/b.txt": []byte("b")} {
+		if got, ok := client.object(key); !ok || !bytes.Equal(got, want) {
+			t.Errorf("%s holds %q, want %q", key, got, want)
+		}
+	}
+	for _, key := range []string{"incoming/a.txt", "incoming/logs/b.txt"} {
+		if _, ok := client.object(key); ok {
+			t.Errorf("source %s was not deleted", key)
+		}
+	}
+	if n := client.callCount("DeleteObject"); n != 2 {
+		t.Errorf("DeleteObject was called %d times, want 2", n)
+	}
+}
@@ -0,0 +1,58 @@
+package uploader
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	defaultPresignExpiry = time.Hour
+	// maxPresignExpiry is the longest expiry SigV4 allows for a presigned URL
+	maxPresignExpiry = 7 * 24 * time.Hour
+)
+
+// PresignedURL is a download link for an uploaded file
+type PresignedURL struct {
+	Path string `json:"path"`
+	Key  string `json:"key"`
+	URL  string `json:"url"`
+}
+
+// setClient sets the S3 client, along with a presigner for it when presigned URLs
+// are enabled. Presigning needs a real *s3.Client, so injected clients get none.
+func (u *Uploader) setClient(client S3API) {
+	u.clientMu.Lock()
+	defer u.clientMu.Unlock()
+	u.setClientLocked(client)
+}
+
+// setClientLocked is setClient for callers that hold clientMu
+func (u *Uploader) setClientLocked(client S3API) {
+	u.s3Client = client
+	u.presigner = nil
+	if s3Client, ok := client.(*s3.Client); ok && u.config.GeneratePresignedURLs {
+		u.presigner = s3.NewPresignClient(s3Client)
+	}
+}
+
+// presignURL returns a GET URL for s3Key valid for PresignExpiry
+func (u *Uploader) presignURL(ctx context.Context, s3Key string) (string, error) {
+	u.clientMu.RLock()
+	presigner := u.presigner
+	u.clientMu.RUnlock()
+	if presigner == nil {
+		return "", fmt.Errorf("presigned URLs need a client created by NewUploader")
+	}
+	req, err := presigner.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(u.config.BucketName),
+		Key:    aws.String(s3Key),
+	}, s3.WithPresignExpires(u.presignExpiry))
+	if err != nil {
+		return "", fmt.Errorf("failed to presign URL: %w", err)
+	}
+	return req.URL, nil
+}
@@ -0,0 +1,224 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cheggaaa/pb/v3"
+	"go.uber.org/zap"
+)
+
+// progressLogInterval is how often progress is logged when the bar is not shown
+const progressLogInterval = 5 * time.Second
+
+// progress tracks completed files and bytes. On a terminal it draws a progress bar;
+// otherwise, or with NoProgress, it logs a progress line every progressLogInterval
+// so CI logs stay free of control characters.
+type progress struct {
+	bar *pb.ProgressBar
+
+	// Totals grow as files are discovered; all counters are updated atomically.
+	// bytes counts files that succeeded and what has been sent of those being uploaded,
+	// so a full bar means nothing failed.
+	totalBytes int64
+	totalFiles int64
+	bytes      int64
+	files      int64 // Processed, whatever the outcome
+	failed     int64
+
+	start time.Time
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// startProgress starts reporting progress. Files are added to the totals with addTotal.
+func (u *Uploader) startProgress() *progress {
+	p := &progress{start: time.Now(), done: make(chan struct{})}
+
+	// The bar is drawn on stderr, so that is the stream that must be a terminal
+	if isTerminal(os.Stderr) && !u.config.NoProgress {
+		// Measure bytes so large files weigh more than small ones
+		p.bar = pb.Full.Start64(0)
+		p.bar.Set(pb.Bytes, true)
+		return p
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(progressLogInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.done:
+				return
+			case <-ticker.C:
+				bytes, totalBytes := atomic.LoadInt64(&p.bytes), atomic.LoadInt64(&p.totalBytes)
+				fields := []zap.Field{
+					zap.Int64("processed_files", atomic.LoadInt64(&p.files)),
+					zap.Int64("failed_files", atomic.LoadInt64(&p.failed)),
+					zap.Int64("total_files", atomic.LoadInt64(&p.totalFiles)),
+					zap.Int64("bytes_done", bytes),
+					zap.Int64("total_bytes", totalBytes),
+					zap.Float64("throughput_mb_per_sec", throughputMBps(bytes, time.Since(p.start))),
+				}
+				if eta, ok := p.eta(totalBytes, u.expectedRate); ok {
+					fields = append(fields, zap.Duration("eta", eta.Round(time.Second)))
+				}
+				u.logger.Info("Progress", fields...)
+			}
+		}
+	}()
+	return p
+}
+
+// eta estimates how long is left until totalBytes are done, from the throughput so far
+// once something has been uploaded and from rate bytes per second before that. A nil
+// progress has uploaded nothing. ok is false when there is nothing to go on.
+func (p *progress) eta(totalBytes, rate int64) (time.Duration, bool) {
+	var done int64
+	if p != nil {
+		done = atomic.LoadInt64(&p.bytes)
+		if elapsed := time.Since(p.start); done > 0 && elapsed > 0 {
+			rate = int64(float64(done) / elapsed.Seconds())
+		}
+	}
+	if rate <= 0 {
+		return 0, false
+	}
+	remaining := max(totalBytes-done, 0)
+	return time.Duration(float64(remaining) / float64(rate) * float64(time.Second)), true
+}
+
+// addTotal adds a discovered file of the given size to the totals
+func (p *progress) addTotal(size int64) {
+	atomic.AddInt64(&p.totalFiles, 1)
+	atomic.AddInt64(&p.totalBytes, size)
+	if p.bar != nil {
+		p.bar.AddTotal(size)
+	}
+}
+
+// add records a processed file. A failed file is counted separately and shown next to
+// the bar instead of advancing it, and what it advanced while being sent is taken back;
+// a skipped file counts as done.
+func (p *progress) add(f *fileProgress, err error) {
+	atomic.AddInt64(&p.files, 1)
+	// Claim the rest of the file so a straggling read can't advance the bar any further
+	sent := atomic.SwapInt64(&f.sent, f.size)
+	if err != nil && !errors.Is(err, ErrSkipped) {
+		failed := atomic.AddInt64(&p.failed, 1)
+		if p.bar != nil {
+			p.bar.Set("suffix", fmt.Sprintf("%d failed", failed))
+		}
+		p.advance(-sent)
+		return
+	}
+	p.advance(f.size - sent)
+}
+
+// advance moves the byte count and the bar by n, which may be negative
+func (p *progress) advance(n int64) {
+	if n == 0 {
+		return
+	}
+	atomic.AddInt64(&p.bytes, n)
+	if p.bar != nil {
+		p.bar.Add64(n)
+	}
+}
+
+// fileProgress is a file's share of the progress. Uploads credit bytes to it as they
+// are sent, so a large file moves the bar while it is uploading rather than only when
+// it completes; progress.add settles the rest.
+type fileProgress struct {
+	p    *progress
+	size int64 // As found during the walk; no more than this is ever credited
+	sent int64 // Credited so far, updated atomically
+}
+
+// startFile returns the share of a file of the given size that is about to be processed
+func (p *progress) startFile(size int64) *fileProgress {
+	return &fileProgress{p: p, size: size}
+}
+
+// credit advances the progress by n bytes sent, stopping at the file's size since a
+// retried request sends some bytes again
+func (f *fileProgress) credit(n int64) {
+	for {
+		sent := atomic.LoadInt64(&f.sent)
+		step := min(n, f.size-sent)
+		if step <= 0 {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&f.sent, sent, sent+step) {
+			f.p.advance(step)
+			return
+		}
+	}
+}
+
+// fileProgressKey is the context key under which withFileProgress stores a fileProgress
+type fileProgressKey struct{}
+
+// withFileProgress returns ctx carrying f, so the request bodies built under it by
+// uploadBody credit f with the bytes they send
+func withFileProgress(ctx context.Context, f *fileProgress) context.Context {
+	return context.WithValue(ctx, fileProgressKey{}, f)
+}
+
+// progressReader credits the bytes read from r to file. Like throttledReader it passes
+// Seek through; bytes read again after the SDK rewinds the body are not credited twice.
+type progressReader struct {
+	r    io.ReadSeeker
+	file *fileProgress
+	pos  int64
+	high int64 // The furthest position read so far
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.pos += int64(n)
+	if r.pos > r.high {
+		r.file.credit(r.pos - r.high)
+		r.high = r.pos
+	}
+	return n, err
+}
+
+func (r *progressReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.r.Seek(offset, whence)
+	if err == nil {
+		r.pos = pos
+	}
+	return pos, err
+}
+
+// retrying takes n failed files out of the processed and failed counts before they are tried again
+func (p *progress) retrying(n int) {
+	atomic.AddInt64(&p.files, -int64(n))
+	failed := atomic.AddInt64(&p.failed, -int64(n))
+	if p.bar != nil {
+		suffix := ""
+		if failed > 0 {
+			suffix = fmt.Sprintf("%d failed", failed)
+		}
+		p.bar.Set("suffix", suffix)
+	}
+}
+
+// finish stops the bar or the periodic log lines
+func (p *progress) finish() {
+	if p.bar != nil {
+		p.bar.Finish()
+		return
+	}
+	close(p.done)
+	p.wg.Wait()
+}
@@ -0,0 +1,266 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// BucketTarget is an additional bucket every file is uploaded to, e.g. in another region
+// for redundancy. Region and S3Prefix default to those of the primary bucket.
+type BucketTarget struct {
+	BucketName string `json:"bucket_name" yaml:"bucket_name"`
+	Region     string `json:"region,omitempty" yaml:"region,omitempty"`
+	S3Prefix   string `json:"s3_prefix,omitempty" yaml:"s3_prefix,omitempty"`
+}
+
+// TargetReport is the outcome of a run in one bucket, listed in a Report when Buckets is set
+type TargetReport struct {
+	Bucket         string `json:"bucket"`
+	Prefix         string `json:"prefix"`
+	Region         string `json:"region"`
+	SucceededFiles int64  `json:"succeeded_files"`
+	SkippedFiles   int64  `json:"skipped_files"`
+	FailedFiles    int64  `json:"failed_files"`
+}
+
+// targetCounts counts the outcomes of files in one bucket, updated atomically by workers
+type targetCounts struct {
+	succeeded, skipped, failed int64
+}
+
+// record counts the outcome of one file. A file that failed before and was tried again
+// has its failure replaced by the new outcome.
+func (c *targetCounts) record(err error, retried bool) {
+	if retried {
+		atomic.AddInt64(&c.failed, -1)
+	}
+	switch {
+	case errors.Is(err, ErrSkipped):
+		atomic.AddInt64(&c.skipped, 1)
+	case err != nil:
+		atomic.AddInt64(&c.failed, 1)
+	default:
+		atomic.AddInt64(&c.succeeded, 1)
+	}
+}
+
+// replica uploads to one BucketTarget. Its uploader has its own config, client and
+// sources, and shares the parsed settings and limits of the primary uploader.
+type replica struct {
+	uploader *Uploader
+	counts   targetCounts
+}
+
+// validateTargets checks Buckets
+func validateTargets(cfg *Config) error {
+	if len(cfg.Buckets) == 0 {
+		return nil
+	}
+	if cfg.Mode != "" && cfg.Mode != ModeUpload {
+		return &ConfigError{Field: "buckets", Message: "only apply in upload mode"}
+	}
+	if cfg.Mirror {
+		return &ConfigError{Field: "buckets", Message: "cannot be combined with mirror, which only deletes from bucket_name"}
+	}
+	seen := map[string]bool{cfg.BucketName + "/" + movePrefix(cfg.S3Prefix): true}
+	for _, target := range cfg.Buckets {
+		if target.BucketName == "" {
+			return &ConfigError{Field: "buckets", Message: "bucket_name is required for every target"}
+		}
+		prefix := target.S3Prefix
+		if prefix == "" {
+			prefix = cfg.S3Prefix
+		}
+		dest := target.BucketName + "/" + movePrefix(prefix)
+		if seen[dest] {
+			return &ConfigError{Field: "buckets", Message: fmt.Sprintf("%q is listed more than once", dest)}
+		}
+		seen[dest] = true
+	}
+	return nil
+}
+
+// addReplicas sets up an uploader for each of Buckets, using newClient to create its
+// S3 client from its config
+func (u *Uploader) addReplicas(newClient func(*Config) (S3API, error)) error {
+	for _, target := range u.config.Buckets {
+		cfg := *u.config
+		cfg.Buckets = nil
+		cfg.BucketName = target.BucketName
+		if target.Region != "" {
+			cfg.Region = target.Region
+		}
+		if target.S3Prefix != "" {
+			cfg.S3Prefix = target.S3Prefix
+		}
+
+		// Keys come from the sources, which carry the prefix
+		sources, err := newSources(&cfg)
+		if err != nil {
+			return err
+		}
+		client, err := newClient(&cfg)
+		if err != nil {
+			return &ConfigError{Field: "buckets", Message: fmt.Sprintf("settings for %q could not be loaded", target.BucketName), Err: err}
+		}
+
+		r := &Uploader{
+			presignExpiry:  u.presignExpiry,
+			config:         &cfg,
+			logger:         u.logger.With(zap.String("bucket", cfg.BucketName)),
+			retryBaseDelay: u.retryBaseDelay,
+			runRetryDelay:  u.runRetryDelay,
+			timeout:        u.timeout,
+			fileTimeout:    u.fileTimeout,
+			limiter:        u.limiter,
+			expectedRate:   u.expectedRate,
+			requests:       u.requests,
+			runID:          u.runID,
+			startTime:      u.startTime,
+			keyTemplate:    u.keyTemplate,
+			minSize:        u.minSize,
+			maxSize:        u.maxSize,
+			modifiedAfter:  u.modifiedAfter,
+			modifiedBefore: u.modifiedBefore,
+			retainUntil:    u.retainUntil,
+			retainFor:      u.retainFor,
+			sources:        sources,
+			ignore:         u.ignore,
+			mimeMap:        u.mimeMap,
+			tracer:         u.tracer,
+		}
+		if cfg.DedupByHash {
+			r.dedup = &dedupIndex{entries: make(map[string]*dedupEntry)}
+		}
+		r.setClient(client)
+		u.replicas = append(u.replicas, &replica{uploader: r})
+	}
+	return nil
+}
+
+// prepareReplicas checks that every replica bucket is reachable and, with SkipExisting,
+// lists what it already holds
+func (u *Uploader) prepareReplicas(ctx context.Context) error {
+	for _, r := range u.replicas {
+		if err := r.uploader.checkBucket(ctx); err != nil {
+			return err
+		}
+		if u.config.SkipExisting {
+			existing, err := r.uploader.listExisting(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to list existing objects in %q: %w", r.uploader.config.BucketName, err)
+			}
+			r.uploader.existing = existing
+		}
+	}
+	return nil
+}
+
+// replicate uploads job to the primary bucket with upload, then to every replica bucket,
+// and returns the outcome for the file as a whole. The file only succeeds when every
+// bucket has it, and is only skipped when every bucket skipped it. Each bucket is tried
+// even when another failed, so one outage doesn't hold back the rest. When the file
+// failed in some buckets before, only those are tried again.
+func (u *Uploader) replicate(ctx context.Context, job LocalFile, upload func() error) error {
+	if len(u.replicas) == 0 {
+		return upload()
+	}
+
+	u.targetErrsMu.Lock()
+	results := slices.Clone(u.targetErrs[job.Path])
+	u.targetErrsMu.Unlock()
+	retried := results != nil
+	if !retried {
+		results = make([]error, len(u.replicas)+1)
+	}
+
+	// Index 0 is the primary bucket, the replicas follow
+	for i := range results {
+		if retried && !isFailure(results[i]) {
+			continue
+		}
+		if i > 0 && ctx.Err() != nil {
+			// The file isn't retried once the run is cancelled, so its state doesn't matter
+			return errors.Join(results[0], ctx.Err())
+		}
+		if i == 0 {
+			results[0] = upload()
+			u.primaryCounts.record(results[0], retried)
+			continue
+		}
+		r := u.replicas[i-1]
+		if job.Dir {
+			results[i] = r.uploader.uploadFolderMarker(ctx, job.Path)
+		} else {
+			_, _, results[i] = r.uploader.uploadFile(ctx, job.Path)
+		}
+		r.counts.record(results[i], retried)
+	}
+
+	var errs []error
+	skipped := true
+	for i, err := range results {
+		bucket := u.config.BucketName
+		if i > 0 {
+			bucket = u.replicas[i-1].uploader.config.BucketName
+		}
+		switch {
+		case isFailure(err):
+			errs = append(errs, fmt.Errorf("bucket %s: %w", bucket, err))
+		case err == nil:
+			skipped = false
+		}
+	}
+
+	u.targetErrsMu.Lock()
+	if len(errs) > 0 {
+		if u.targetErrs == nil {
+			u.targetErrs = make(map[string][]error)
+		}
+		u.targetErrs[job.Path] = results
+	} else {
+		delete(u.targetErrs, job.Path)
+	}
+	u.targetErrsMu.Unlock()
+
+	switch {
+	case len(errs) > 0:
+		return errors.Join(errs...)
+	case skipped:
+		return results[0]
+	}
+	return nil
+}
+
+// isFailure reports whether err is the outcome of a file that failed rather than
+// succeeded or was skipped
+func isFailure(err error) bool {
+	return err != nil && !errors.Is(err, ErrSkipped)
+}
+
+// targetReports returns the outcome in each bucket, primary first, or nil without Buckets
+func (u *Uploader) targetReports() []TargetReport {
+	if len(u.replicas) == 0 {
+		return nil
+	}
+	report := func(cfg *Config, counts *targetCounts) TargetReport {
+		return TargetReport{
+			Bucket:         cfg.BucketName,
+			Prefix:         cfg.S3Prefix,
+			Region:         cfg.Region,
+			SucceededFiles: atomic.LoadInt64(&counts.succeeded),
+			SkippedFiles:   atomic.LoadInt64(&counts.skipped),
+			FailedFiles:    atomic.LoadInt64(&counts.failed),
+		}
+	}
+	reports := []TargetReport{report(u.config, &u.primaryCounts)}
+	for _, r := range u.replicas {
+		reports = append(reports, report(r.uploader.config, &r.counts))
+	}
+	return reports
+}
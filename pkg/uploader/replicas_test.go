@@ -0,0 +1,63 @@
+package uploader
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"slices"
+	"testing"
+)
+
+// newReplicatedUploader returns an uploader for dir with one replica bucket, each with
+// its own fakeS3
+func newReplicatedUploader(t *testing.T, dir string, configure func(*Config)) (*Uploader, *fakeS3, *fakeS3) {
+	t.Helper()
+	u, primary := newTestUploader(t, dir, func(cfg *Config) {
+		cfg.Buckets = []BucketTarget{{BucketName: "replica-bucket"}}
+		if configure != nil {
+			configure(cfg)
+		}
+	})
+	replica := newFakeS3()
+	u.replicas[0].uploader.setClient(replica)
+	return u, primary, replica
+}
+
+func TestReplicateRetriesOnlyFailedBuckets(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "report.csv", 1024)
+	u, primary, replica := newReplicatedUploader(t, dir, func(cfg *Config) {
+		cfg.RunRetries = 1
+		cfg.RunRetryDelay = "1ms"
+	})
+	replica.failNext("PutObject", apiError("AccessDenied"))
+
+	if err := u.UploadWithContext(context.Background()); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+
+	if n := primary.callCount("PutObject"); n != 1 {
+		t.Errorf("primary bucket got %d uploads, want 1", n)
+	}
+	if n := replica.callCount("PutObject"); n != 2 {
+		t.Errorf("replica bucket got %d uploads, want 2", n)
+	}
+	for _, report := range u.targetReports() {
+		if report.SucceededFiles != 1 || report.FailedFiles != 0 || report.SkippedFiles != 0 {
+			t.Errorf("%s: succeeded=%d failed=%d skipped=%d, want only 1 succeeded",
+				report.Bucket, report.SucceededFiles, report.FailedFiles, report.SkippedFiles)
+		}
+	}
+}
+
+func TestUnreadablePathsIncludeReplicas(t *testing.T) {
+	u, _, _ := newReplicatedUploader(t, t.TempDir(), nil)
+	denied := fmt.Errorf("open: %w", fs.ErrPermission)
+	u.skipUnreadable("a.txt", denied)
+	u.replicas[0].uploader.skipUnreadable("a.txt", denied)
+	u.replicas[0].uploader.skipUnreadable("b.txt", denied)
+
+	if got, want := u.unreadablePaths(), []string{"a.txt", "b.txt"}; !slices.Equal(got, want) {
+		t.Errorf("unreadablePaths() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,54 @@
+package uploader
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Report is the machine-readable summary written to ReportPath at the end of a run
+type Report struct {
+	RunID       string    `json:"run_id"`
+	Bucket      string    `json:"bucket"`
+	Prefix      string    `json:"prefix"`
+	StartTime   time.Time `json:"start_time"`
+	EndTime     time.Time `json:"end_time"`
+	DryRun      bool      `json:"dry_run"`
+	Interrupted bool      `json:"interrupted"`
+
+	TotalFiles     int `json:"total_files"`
+	SucceededFiles int `json:"succeeded_files"`
+	SkippedFiles   int `json:"skipped_files"`
+	ExistingFiles  int `json:"existing_files,omitempty"` // Skipped because NoOverwrite found the key taken
+	FailedFiles    int `json:"failed_files"`
+	DeletedFiles   int `json:"deleted_local_files,omitempty"`
+
+	TotalBytes      int64   `json:"total_bytes"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	ThroughputMBps  float64 `json:"throughput_mb_per_sec"`
+
+	Failures      []ReportFailure `json:"failures"`
+	PresignedURLs []PresignedURL  `json:"presigned_urls,omitempty"`
+	Targets       []TargetReport  `json:"targets,omitempty"` // Per bucket when Buckets is set
+
+	UnreadablePaths []string `json:"unreadable_paths,omitempty"` // Skipped because of SkipUnreadable
+}
+
+// ReportFailure is a failed file in a Report
+type ReportFailure struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// writeReport writes report as indented JSON to path
+func writeReport(path string, report *Report) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode report: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/smithy-go"
+	"go.uber.org/zap"
+)
+
+// withRetry runs fn, retrying retryable errors with exponential backoff and jitter
+func (u *Uploader) withRetry(ctx context.Context, operation, s3Key string, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		if err := u.requests.wait(ctx); err != nil {
+			return err
+		}
+		err := fn()
+		if isThrottling(err) {
+			atomic.AddInt64(&u.throttleEvents, 1)
+			if limit, lowered := u.requests.throttled(); lowered {
+				u.logger.Info("S3 is throttling requests; lowering the request rate",
+					zap.String("operation", operation),
+					zap.Float64("requests_per_second", float64(limit)))
+			}
+		}
+		if err == nil || attempt > u.config.MaxRetries || !isRetryable(err) {
+			return err
+		}
+
+		delay := backoffDelay(u.retryBaseDelay, attempt)
+		u.logger.Debug("Retrying after transient error",
+			zap.String("operation", operation),
+			zap.String("s3_key", s3Key),
+			zap.Int("attempt", attempt),
+			zap.Duration("delay", delay),
+			zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// isRetryable reports whether err is a throttling, transient server or connection error
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	if isThrottling(err) {
+		return true
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		// ConditionalRequestConflict means a conditional write raced another write to the key
+		case "RequestTimeout", "InternalError", "ServiceUnavailable", "ConditionalRequestConflict":
+			return true
+		}
+	}
+
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) {
+		switch respErr.HTTPStatusCode() {
+		case http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+	}
+
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// isThrottling reports whether err means S3 is asking clients to slow down
+func isThrottling(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "SlowDown", "Throttling", "ThrottlingException", "RequestLimitExceeded", "TooManyRequestsException":
+			return true
+		}
+	}
+	return false
+}
+
+// backoffDelay returns the delay before the given retry attempt, using exponential backoff with jitter
+func backoffDelay(base time.Duration, attempt int) time.Duration {
+	delay := base
+	for i := 1; i < attempt && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	// Pick a random delay in [delay/2, delay) so concurrent workers don't retry in lockstep
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
@@ -0,0 +1,44 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{apiError("SlowDown"), true},
+		{apiError("RequestTimeout"), true},
+		{apiError("InternalError"), true},
+		{fmt.Errorf("failed to upload part: %w", apiError("ServiceUnavailable")), true},
+		{io.ErrUnexpectedEOF, true},
+		{apiError("AccessDenied"), false},
+		{apiError("NoSuchBucket"), false},
+		{context.Canceled, false},
+		{context.DeadlineExceeded, false},
+		{errors.New("some other error"), false},
+	}
+	for _, test := range tests {
+		if got := isRetryable(test.err); got != test.want {
+			t.Errorf("isRetryable(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	base := 100 * time.Millisecond
+	for attempt := 1; attempt <= 20; attempt++ {
+		limit := min(base<<(attempt-1), maxRetryDelay)
+		delay := backoffDelay(base, attempt)
+		if delay < limit/2 || delay > limit {
+			t.Errorf("backoffDelay(%v, %d) = %v, want between %v and %v", base, attempt, delay, limit/2, limit)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package uploader
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// SidecarSuffix names the file that supplies per-file object attributes when
+// SidecarMetadata is set, e.g. "photo.jpg.meta.json" for "photo.jpg"
+const SidecarSuffix = ".meta.json"
+
+// Sidecar is the content of a sidecar file. Its metadata and tags are merged over the
+// configured ones, and its content type replaces the detected one.
+type Sidecar struct {
+	ContentType string            `json:"content_type,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+}
+
+// isSidecar reports whether a relative path is a sidecar file, which is never uploaded itself
+func (u *Uploader) isSidecar(relPath string) bool {
+	return u.config.SidecarMetadata && strings.HasSuffix(path.Base(relPath), SidecarSuffix)
+}
+
+// readSidecar returns the sidecar next to filePath, or nil if there is none
+func (u *Uploader) readSidecar(filePath string) (*Sidecar, error) {
+	if !u.config.SidecarMetadata {
+		return nil, nil
+	}
+
+	sidecarPath := filePath + SidecarSuffix
+	data, err := os.ReadFile(sidecarPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sidecar file: %w", err)
+	}
+
+	// Reject unknown fields so a typo doesn't silently drop an attribute
+	var sidecar Sidecar
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&sidecar); err != nil {
+		return nil, fmt.Errorf("failed to parse sidecar file %s: %w", sidecarPath, err)
+	}
+
+	for key := range sidecar.Metadata {
+		if key == "" || !isASCII(key) {
+			return nil, fmt.Errorf("invalid metadata key in sidecar file %s: %q", sidecarPath, key)
+		}
+	}
+	return &sidecar, nil
+}
+
+// isASCII reports whether s only contains ASCII characters
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,134 @@
+package uploader
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// source is a validated entry from Config.AllSources
+type source struct {
+	localPath string // As configured
+	root      string // Directory keys are relative to: localPath, or its parent when localPath is a file
+	prefix    string // S3Prefix joined with the source's own prefix
+}
+
+// isFile reports whether the source is a single file rather than a directory
+func (s *source) isFile() bool {
+	return s.root != s.localPath
+}
+
+// keyPrefix returns the source's prefix as it appears at the start of every key, e.g. "uploads/"
+func (s *source) keyPrefix() string {
+	prefix := strings.Trim(filepath.ToSlash(s.prefix), "/")
+	if prefix == "" {
+		return ""
+	}
+	return path.Clean(prefix) + "/"
+}
+
+// newSources validates the configured sources. Sources may not contain one another,
+// and with Mirror each must be a directory and no prefix may be nested in another.
+func newSources(cfg *Config) ([]source, error) {
+	configured := cfg.AllSources()
+	if len(configured) == 0 {
+		return nil, &ConfigError{Field: "local_path", Message: "is required in config"}
+	}
+
+	sources := make([]source, 0, len(configured))
+	for i, s := range configured {
+		field := "local_path"
+		if cfg.LocalPath == "" || i > 0 {
+			field = "sources"
+		}
+		if s.LocalPath == "" {
+			return nil, &ConfigError{Field: field, Message: "local_path is required for every source"}
+		}
+
+		// A download creates its local directory, so only an upload source has to exist
+		info, err := os.Stat(s.LocalPath)
+		if os.IsNotExist(err) && cfg.Mode != ModeDownload {
+			return nil, &ConfigError{Field: field, Message: "does not exist: " + s.LocalPath}
+		}
+		src := source{
+			localPath: filepath.Clean(s.LocalPath),
+			root:      filepath.Clean(s.LocalPath),
+			prefix:    filepath.Join(cfg.S3Prefix, s.S3Prefix),
+		}
+		if err == nil && !info.IsDir() {
+			if cfg.Mode == ModeDownload {
+				return nil, &ConfigError{Field: field, Message: "must be a directory in download mode: " + s.LocalPath}
+			}
+			if cfg.Mirror {
+				return nil, &ConfigError{Field: field, Message: "must be a directory when mirror is enabled: " + s.LocalPath}
+			}
+			src.root = filepath.Dir(src.localPath)
+		}
+
+		for _, other := range sources {
+			if within(other.localPath, src.localPath) || within(src.localPath, other.localPath) {
+				return nil, &ConfigError{Field: "sources", Message: fmt.Sprintf("%q and %q overlap", other.localPath, src.localPath)}
+			}
+			if cfg.Mirror && other.keyPrefix() != src.keyPrefix() &&
+				(strings.HasPrefix(src.keyPrefix(), other.keyPrefix()) || strings.HasPrefix(other.keyPrefix(), src.keyPrefix())) {
+				return nil, &ConfigError{Field: "sources", Message: fmt.Sprintf(
+					"prefixes %q and %q are nested, so mirror could delete one source's objects as stale for the other",
+					other.prefix, src.prefix)}
+			}
+		}
+		sources = append(sources, src)
+	}
+	return sources, nil
+}
+
+// within reports whether target is dir or a path below it
+func within(dir, target string) bool {
+	rel, err := filepath.Rel(dir, target)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// sourceFor returns the source a local path was found under, or nil
+func (u *Uploader) sourceFor(filePath string) *source {
+	for i := range u.sources {
+		src := &u.sources[i]
+		if src.isFile() {
+			if filePath == src.localPath {
+				return src
+			}
+		} else if within(src.localPath, filePath) {
+			return src
+		}
+	}
+	return nil
+}
+
+// listPrefixes returns the distinct key prefixes to list, dropping any nested in another
+func (u *Uploader) listPrefixes() []string {
+	var prefixes []string
+	for _, src := range u.sources {
+		prefix := src.keyPrefix()
+		covered := false
+		for _, other := range u.sources {
+			if p := other.keyPrefix(); p != prefix && strings.HasPrefix(prefix, p) {
+				covered = true
+				break
+			}
+		}
+		if covered {
+			continue
+		}
+		duplicate := false
+		for _, p := range prefixes {
+			if p == prefix {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
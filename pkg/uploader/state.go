@@ -0,0 +1,118 @@
+package uploader
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// stateFlushEvery and stateFlushInterval bound how much progress is lost if the process dies
+	stateFlushEvery    = 100
+	stateFlushInterval = 10 * time.Second
+)
+
+// stateEntry records a completed upload along with the file's size and modification
+// time, so a file that changed since is uploaded again
+type stateEntry struct {
+	Size    int64 `json:"size"`
+	ModTime int64 `json:"mtime"` // Unix nanoseconds
+}
+
+// uploadState is the checkpoint kept in StateFile. It maps S3 keys to completed uploads.
+type uploadState struct {
+	mu        sync.Mutex
+	path      string
+	Files     map[string]stateEntry `json:"files"`
+	pending   int
+	lastFlush time.Time
+}
+
+// loadState reads the state file at path. A missing file is an empty state.
+func loadState(path string) (*uploadState, error) {
+	state := &uploadState{path: path, Files: make(map[string]stateEntry), lastFlush: time.Now()}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to parse state file: %w", err)
+	}
+	if state.Files == nil {
+		state.Files = make(map[string]stateEntry)
+	}
+	return state, nil
+}
+
+// done reports whether s3Key was uploaded from a file with this size and modification time
+func (s *uploadState) done(s3Key string, size int64, modTime time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.Files[s3Key]
+	return ok && entry.Size == size && entry.ModTime == modTime.UnixNano()
+}
+
+// record marks s3Key as uploaded, flushing to disk every few files or seconds
+func (s *uploadState) record(s3Key string, size int64, modTime time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Files[s3Key] = stateEntry{Size: size, ModTime: modTime.UnixNano()}
+	s.pending++
+	if s.pending >= stateFlushEvery || time.Since(s.lastFlush) >= stateFlushInterval {
+		return s.flushLocked()
+	}
+	return nil
+}
+
+// flush writes any recorded uploads to disk
+func (s *uploadState) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending == 0 {
+		return nil
+	}
+	return s.flushLocked()
+}
+
+// flushLocked writes the state to a temporary file and renames it into place, so a
+// crash mid-write never leaves a truncated state file behind
+func (s *uploadState) flushLocked() error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+
+	s.pending = 0
+	s.lastFlush = time.Now()
+	return nil
+}
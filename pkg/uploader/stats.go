@@ -0,0 +1,55 @@
+package uploader
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// maxDurationSamples bounds the memory used for file duration percentiles
+const maxDurationSamples = 10000
+
+// durationSample keeps a uniform random sample of at most maxDurationSamples durations
+// (reservoir sampling), so percentiles can be estimated for any number of files
+type durationSample struct {
+	samples []time.Duration
+	seen    int
+}
+
+// add offers a duration to the sample
+func (s *durationSample) add(d time.Duration) {
+	s.seen++
+	if len(s.samples) < maxDurationSamples {
+		s.samples = append(s.samples, d)
+		return
+	}
+	if i := rand.Intn(s.seen); i < maxDurationSamples {
+		s.samples[i] = d
+	}
+}
+
+// sorted returns the sampled durations in ascending order
+func (s *durationSample) sorted() []time.Duration {
+	sort.Slice(s.samples, func(i, j int) bool { return s.samples[i] < s.samples[j] })
+	return s.samples
+}
+
+// percentile returns the p-th percentile (0-100) of sorted durations using the nearest-rank method
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// throughputMBps returns the average transfer rate in megabytes (MiB) per second
+func throughputMBps(bytes int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(bytes) / (1024 * 1024) / elapsed.Seconds()
+}
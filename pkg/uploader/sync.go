@@ -0,0 +1,215 @@
+package uploader
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"go.uber.org/zap"
+)
+
+// remoteObject describes an object that already exists in the bucket
+type remoteObject struct {
+	Size int64
+	ETag string
+}
+
+// trimETag returns an ETag without the quotes S3 wraps it in
+func trimETag(etag *string) string {
+	return strings.Trim(aws.ToString(etag), `"`)
+}
+
+// listExisting lists every object under each source's prefix, keyed by S3 key
+func (u *Uploader) listExisting(ctx context.Context) (map[string]remoteObject, error) {
+	existing := make(map[string]remoteObject)
+
+	for _, prefix := range u.listPrefixes() {
+		paginator := s3.NewListObjectsV2Paginator(u.client(), &s3.ListObjectsV2Input{
+			Bucket:       aws.String(u.config.BucketName),
+			RequestPayer: u.requestPayer(),
+			Prefix:       aws.String(prefix),
+		})
+		for paginator.HasMorePages() {
+			if err := u.requests.wait(ctx); err != nil {
+				return nil, err
+			}
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return nil, err
+			}
+			for _, obj := range page.Contents {
+				existing[aws.ToString(obj.Key)] = remoteObject{
+					Size: aws.ToInt64(obj.Size),
+					ETag: trimETag(obj.ETag),
+				}
+			}
+		}
+	}
+
+	return existing, nil
+}
+
+// isUnchanged reports whether the object at s3Key matches the local file's size and,
+// when CompareETag is set, its MD5. Multipart ETags are not MD5s so only sizes are compared for them.
+// With SyncModeHash the SHA-256 is compared instead, and returned so the upload needn't
+// hash the file again.
+func (u *Uploader) isUnchanged(ctx context.Context, file *os.File, s3Key string, size int64) (bool, string, error) {
+	remote, ok := u.existing[s3Key]
+	if !ok || remote.Size != size {
+		return false, "", nil
+	}
+
+	if u.config.SyncMode == SyncModeHash {
+		return u.hashUnchanged(ctx, file, s3Key, size)
+	}
+
+	if !u.config.CompareETag || strings.Contains(remote.ETag, "-") {
+		return true, "", nil
+	}
+
+	hash := md5.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(file, 0, size)); err != nil {
+		return false, "", fmt.Errorf("failed to hash file: %w", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)) == remote.ETag, "", nil
+}
+
+// hashUnchanged reports whether the x-amz-meta-sha256 of the object at s3Key matches
+// the local file's SHA-256, which it returns. Only objects the listing shows to be the
+// same size get here, so the HeadObject is skipped for new and resized files. An object
+// without the metadata, e.g. one uploaded before SyncModeHash was set, counts as changed.
+func (u *Uploader) hashUnchanged(ctx context.Context, file *os.File, s3Key string, size int64) (bool, string, error) {
+	checksum, err := fileSHA256(io.NewSectionReader(file, 0, size))
+	if err != nil {
+		return false, "", fmt.Errorf("failed to hash file: %w", err)
+	}
+
+	if err := u.requests.wait(ctx); err != nil {
+		return false, "", err
+	}
+	out, err := u.client().HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(u.config.BucketName),
+		RequestPayer: u.requestPayer(),
+		Key:          aws.String(s3Key),
+	})
+	if err != nil {
+		return false, "", fmt.Errorf("failed to read stored checksum: %w", err)
+	}
+
+	stored, ok := out.Metadata[MetadataSHA256]
+	if !ok {
+		u.logger.Debug("Object has no stored SHA-256; uploading it again",
+			zap.String("s3_key", s3Key))
+	}
+	return stored == checksum, checksum, nil
+}
+
+// deleteStale deletes objects under the source prefixes that don't correspond to any of the local files.
+// Objects that the include/exclude filters would not have selected are left alone.
+// Nothing is deleted when paths were skipped as unreadable, since their objects would
+// look stale.
+func (u *Uploader) deleteStale(ctx context.Context, localKeys map[string]struct{}) error {
+	if unreadable := u.unreadablePaths(); len(unreadable) > 0 {
+		u.logger.Warn("Skipping mirror deletes because some paths could not be read",
+			zap.Int("unreadable_paths", len(unreadable)))
+		return nil
+	}
+
+	remote, err := u.listExisting(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	var stale []string
+	for key := range remote {
+		if _, ok := localKeys[key]; ok || strings.HasSuffix(key, "/") {
+			continue
+		}
+		// The manifest has no local file but is rewritten on every run
+		if u.config.GenerateManifest && key == u.manifestKey() {
+			continue
+		}
+		// Mirror rejects nested prefixes, so at most one distinct prefix matches
+		var relKey string
+		for _, src := range u.sources {
+			if prefix := src.keyPrefix(); strings.HasPrefix(key, prefix) {
+				relKey = strings.TrimPrefix(key, prefix)
+				break
+			}
+		}
+		// Filters see paths as they are on disk, before StripPrefix removed the prefix
+		relKey = u.stripPrefix() + relKey
+		// A compressed object's key has GzipExtension after the file's own name
+		if ext := aws.ToString(u.config.GzipExtension); u.config.Gzip && ext != "" && strings.HasSuffix(relKey, ext) {
+			gzipped, err := u.shouldGzip(strings.TrimSuffix(relKey, ext))
+			if err != nil {
+				return err
+			}
+			if gzipped {
+				relKey = strings.TrimSuffix(relKey, ext)
+			}
+		}
+		selected, err := u.isSelected(relKey)
+		if err != nil {
+			return err
+		}
+		if selected {
+			stale = append(stale, key)
+		}
+	}
+	sort.Strings(stale)
+
+	if u.config.DryRun {
+		for _, key := range stale {
+			u.logger.Info("Dry run: would delete object", zap.String("s3_key", key))
+		}
+		u.logger.Info("Dry run: mirror plan", zap.Int("objects_to_delete", len(stale)))
+		return nil
+	}
+
+	// DeleteObjects accepts at most 1000 keys per request
+	const batchSize = 1000
+	for start := 0; start < len(stale); start += batchSize {
+		end := start + batchSize
+		if end > len(stale) {
+			end = len(stale)
+		}
+
+		objects := make([]types.ObjectIdentifier, 0, end-start)
+		for _, key := range stale[start:end] {
+			objects = append(objects, types.ObjectIdentifier{Key: aws.String(key)})
+		}
+
+		if err := u.requests.wait(ctx); err != nil {
+			return err
+		}
+		out, err := u.client().DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket:       aws.String(u.config.BucketName),
+			RequestPayer: u.requestPayer(),
+			Delete:       &types.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return err
+		}
+		for _, deleteErr := range out.Errors {
+			u.logger.Error("Failed to delete object",
+				zap.String("s3_key", aws.ToString(deleteErr.Key)),
+				zap.String("code", aws.ToString(deleteErr.Code)),
+				zap.String("message", aws.ToString(deleteErr.Message)))
+		}
+		if len(out.Errors) > 0 {
+			return fmt.Errorf("failed to delete %d objects", len(out.Errors))
+		}
+	}
+
+	u.logger.Info("Deleted stale objects", zap.Int("count", len(stale)))
+	return nil
+}
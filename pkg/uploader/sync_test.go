@@ -0,0 +1,70 @@
+package uploader
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"testing"
+)
+
+func TestDeleteStale(t *testing.T) {
+	u, client := newTestUploader(t, t.TempDir(), func(cfg *Config) {
+		cfg.Mirror = true
+	})
+	client.objects["backup/kept.txt"] = []byte("kept")
+	client.objects["backup/gone.txt"] = []byte("gone")
+
+	if err := u.deleteStale(context.Background(), map[string]struct{}{"backup/kept.txt": {}}); err != nil {
+		t.Fatalf("deleteStale: %v", err)
+	}
+	if _, ok := client.object("backup/gone.txt"); ok {
+		t.Error("object without a local file was not deleted")
+	}
+	if _, ok := client.object("backup/kept.txt"); !ok {
+		t.Error("object of a local file was deleted")
+	}
+}
+
+func TestDeleteStaleGzippedObjects(t *testing.T) {
+	u, client := newTestUploader(t, t.TempDir(), func(cfg *Config) {
+		cfg.Mirror = true
+		cfg.Gzip = true
+		cfg.Patterns = []string{"*.txt"}
+	})
+	client.objects["backup/kept.txt.gz"] = []byte("kept")
+	client.objects["backup/gone.txt.gz"] = []byte("gone")
+	// Not something the patterns would have uploaded
+	client.objects["backup/other.log.gz"] = []byte("other")
+
+	if err := u.deleteStale(context.Background(), map[string]struct{}{"backup/kept.txt.gz": {}}); err != nil {
+		t.Fatalf("deleteStale: %v", err)
+	}
+	if _, ok := client.object("backup/gone.txt.gz"); ok {
+		t.Error("compressed object without a local file was not deleted")
+	}
+	for _, key := range []string{"backup/kept.txt.gz", "backup/other.log.gz"} {
+		if _, ok := client.object(key); !ok {
+			t.Errorf("%s was deleted", key)
+		}
+	}
+}
+
+func TestDeleteStaleSkipsRunsWithUnreadablePaths(t *testing.T) {
+	u, client := newTestUploader(t, t.TempDir(), func(cfg *Config) {
+		cfg.Mirror = true
+	})
+	client.objects["backup/private/secret.txt"] = []byte("secret")
+	if !u.skipUnreadable("private", fmt.Errorf("open private: %w", fs.ErrPermission)) {
+		t.Fatal("permission error was not skipped")
+	}
+
+	if err := u.deleteStale(context.Background(), map[string]struct{}{}); err != nil {
+		t.Fatalf("deleteStale: %v", err)
+	}
+	if n := client.callCount("DeleteObjects"); n != 0 {
+		t.Errorf("DeleteObjects was called %d times after a path was unreadable", n)
+	}
+	if _, ok := client.object("backup/private/secret.txt"); !ok {
+		t.Error("object of an unreadable file was deleted")
+	}
+}
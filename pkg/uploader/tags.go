@@ -0,0 +1,126 @@
+package uploader
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// TierTagKey is the tag set from Config.Tier, for use in lifecycle rule filters
+const TierTagKey = "tier"
+
+// tierStorageClasses maps each allowed Tier to the storage class used when TierStorageClass is set
+var tierStorageClasses = map[string]types.StorageClass{
+	"hot":     types.StorageClassStandard,
+	"warm":    types.StorageClassStandardIa,
+	"cold":    types.StorageClassGlacierIr,
+	"archive": types.StorageClassDeepArchive,
+}
+
+const (
+	maxTagsPerObject = 10
+	maxTagKeyLength  = 128
+	maxTagValueLen   = 256
+)
+
+// newRunID returns an identifier for this run, e.g. "20240115T093000Z-3f9a1c2e"
+func newRunID() string {
+	buf := make([]byte, 4)
+	_, _ = rand.Read(buf)
+	return time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(buf)
+}
+
+// tagReplacer returns a replacer for the placeholders allowed in tag values
+func (u *Uploader) tagReplacer(relPath string) *strings.Replacer {
+	hostname, _ := os.Hostname()
+	return strings.NewReplacer(
+		"{run_id}", u.runID,
+		"{hostname}", hostname,
+		"{user}", os.Getenv("USER"),
+		"{rel_path}", filepath.ToSlash(relPath),
+	)
+}
+
+// objectTagging builds the URL-encoded tag set for a file, expanding placeholders in tag
+// values. extra tags, e.g. from a sidecar file, are added as is and override configured ones.
+func (u *Uploader) objectTagging(relPath string, extra map[string]string) (string, error) {
+	if len(u.config.Tags) == 0 && len(extra) == 0 {
+		return "", nil
+	}
+
+	replacer := u.tagReplacer(relPath)
+	values := url.Values{}
+	for key, value := range u.config.Tags {
+		value = replacer.Replace(value)
+		if err := validateTag(key, value); err != nil {
+			return "", err
+		}
+		values.Set(key, value)
+	}
+	for key, value := range extra {
+		if err := validateTag(key, value); err != nil {
+			return "", err
+		}
+		values.Set(key, value)
+	}
+	if len(values) > maxTagsPerObject {
+		return "", fmt.Errorf("at most %d tags are allowed per object, got %d", maxTagsPerObject, len(values))
+	}
+	return values.Encode(), nil
+}
+
+// validateTags checks the configured tags against S3's limits. Values are checked
+// with placeholders expanded for an empty path, since {rel_path} is only known per file.
+func (u *Uploader) validateTags() error {
+	if len(u.config.Tags) > maxTagsPerObject {
+		return fmt.Errorf("at most %d tags are allowed per object, got %d", maxTagsPerObject, len(u.config.Tags))
+	}
+
+	replacer := u.tagReplacer("")
+	for key, value := range u.config.Tags {
+		if err := validateTag(key, replacer.Replace(value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateTag checks a single tag against S3's length and character rules
+func validateTag(key, value string) error {
+	if key == "" || utf8.RuneCountInString(key) > maxTagKeyLength {
+		return fmt.Errorf("tag key must be 1-%d characters: %q", maxTagKeyLength, key)
+	}
+	if strings.HasPrefix(strings.ToLower(key), "aws:") {
+		return fmt.Errorf("tag key must not start with \"aws:\": %q", key)
+	}
+	if utf8.RuneCountInString(value) > maxTagValueLen {
+		return fmt.Errorf("tag value for %q must be at most %d characters", key, maxTagValueLen)
+	}
+	if !isValidTagText(key) {
+		return fmt.Errorf("tag key contains characters S3 does not allow: %q", key)
+	}
+	if !isValidTagText(value) {
+		return fmt.Errorf("tag value for %q contains characters S3 does not allow: %q", key, value)
+	}
+	return nil
+}
+
+// isValidTagText reports whether s only uses letters, numbers, spaces and + - = . _ : / @
+func isValidTagText(s string) bool {
+	for _, r := range s {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) || unicode.IsSpace(r) || strings.ContainsRune("+-=._:/@", r) {
+			continue
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,153 @@
+package uploader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// byteUnits maps size suffixes to multipliers. Units are binary, so "MB" means MiB
+// to match how throughput is reported.
+var byteUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	// Longer suffixes first so "MIB" isn't matched as "B"
+	{"KIB", 1 << 10}, {"MIB", 1 << 20}, {"GIB", 1 << 30},
+	{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30},
+	{"B", 1},
+}
+
+// parseByteSize parses a size such as "512KB", "5MB" or "1048576"
+func parseByteSize(s string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+// formatBytes formats a size with the largest binary unit parseByteSize accepts, e.g. "1.5GB"
+func formatBytes(n int64) string {
+	units := []string{"GB", "MB", "KB"}
+	for i, unit := range units {
+		if size := int64(1) << (10 * (len(units) - i)); n >= size {
+			return strconv.FormatFloat(float64(n)/float64(size), 'f', 1, 64) + unit
+		}
+	}
+	return strconv.FormatInt(n, 10) + "B"
+}
+
+// throttledReader limits reads from r to the rate allowed by limiter. It passes Seek
+// through so the SDK can still rewind the body and compute its length.
+type throttledReader struct {
+	ctx     context.Context
+	r       io.ReadSeeker
+	limiter *rate.Limiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	// WaitN fails for more than the burst size, so read at most that much at once
+	if burst := t.limiter.Burst(); len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if waitErr := t.limiter.WaitN(t.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+func (t *throttledReader) Seek(offset int64, whence int) (int64, error) {
+	return t.r.Seek(offset, whence)
+}
+
+// uploadBody wraps r, the body of a request that sends file content, so that it credits
+// the file's progress when ctx carries one, and is throttled to MaxBandwidth
+func (u *Uploader) uploadBody(ctx context.Context, r io.ReadSeeker) io.ReadSeeker {
+	if f, ok := ctx.Value(fileProgressKey{}).(*fileProgress); ok {
+		r = &progressReader{r: r, file: f}
+	}
+	return u.throttle(ctx, r)
+}
+
+// throttle wraps r with the shared bandwidth limiter. Without MaxBandwidth r is returned as is.
+func (u *Uploader) throttle(ctx context.Context, r io.ReadSeeker) io.ReadSeeker {
+	if u.limiter == nil {
+		return r
+	}
+	return &throttledReader{ctx: ctx, r: r, limiter: u.limiter}
+}
+
+// requestRecoveryInterval is how long the request rate stays lowered after throttling
+// before it is raised again by a tenth of MaxRequestsPerSecond
+const requestRecoveryInterval = 10 * time.Second
+
+// requestLimiter spaces out S3 requests from all workers to MaxRequestsPerSecond.
+// Each throttling response halves the rate, which then climbs back while S3 accepts
+// requests. All methods are safe to call on a nil *requestLimiter, which never waits.
+type requestLimiter struct {
+	limiter *rate.Limiter
+	max     rate.Limit
+
+	mu       sync.Mutex
+	lastStep time.Time // When the rate was last lowered or raised
+}
+
+// newRequestLimiter allows perSecond requests a second without bursts, so they are
+// spread evenly rather than sent in batches
+func newRequestLimiter(perSecond int) *requestLimiter {
+	return &requestLimiter{limiter: rate.NewLimiter(rate.Limit(perSecond), 1), max: rate.Limit(perSecond)}
+}
+
+// wait blocks until the next request may be sent
+func (l *requestLimiter) wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	if current := l.limiter.Limit(); current < l.max && time.Since(l.lastStep) >= requestRecoveryInterval {
+		l.limiter.SetLimit(min(l.max, current+l.max/10))
+		l.lastStep = time.Now()
+	}
+	l.mu.Unlock()
+	return l.limiter.Wait(ctx)
+}
+
+// throttled halves the rate after S3 throttled a request, down to one request a second.
+// Concurrent requests are often throttled together, so the rate is lowered at most once
+// a second. It returns the new rate and whether it changed.
+func (l *requestLimiter) throttled() (rate.Limit, bool) {
+	if l == nil {
+		return 0, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	current := l.limiter.Limit()
+	if current <= 1 || time.Since(l.lastStep) < time.Second {
+		return current, false
+	}
+	lowered := max(1, current/2)
+	l.limiter.SetLimit(lowered)
+	l.lastStep = time.Now()
+	return lowered, true
+}
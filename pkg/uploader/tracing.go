@@ -0,0 +1,58 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// tracerName identifies the spans created by this package
+const tracerName = "github.com/bimat0206/aws-s3-uploader/pkg/uploader"
+
+// traceFlushTimeout bounds sending the remaining spans at the end of a run
+const traceFlushTimeout = 10 * time.Second
+
+// newTracerProvider creates a tracer provider that batches spans to an OTLP/HTTP
+// collector at endpoint, e.g. "http://localhost:4318". Nothing is sent until the first span ends.
+func newTracerProvider(endpoint string) (*sdktrace.TracerProvider, error) {
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", defaultSessionName))),
+	), nil
+}
+
+// flushTraces sends buffered spans so a short run doesn't exit before they are exported.
+// It uses its own timeout because the run's context may already be cancelled.
+func (u *Uploader) flushTraces() {
+	if u.tracerProvider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), traceFlushTimeout)
+	defer cancel()
+	if err := u.tracerProvider.ForceFlush(ctx); err != nil {
+		u.logger.Warn("Failed to export traces", zap.String("endpoint", u.config.OTLPEndpoint), zap.Error(err))
+	}
+}
+
+// endSpan records err on span, unless it only reports a skipped file, and ends it
+func endSpan(span trace.Span, err error) {
+	if errors.Is(err, ErrSkipped) {
+		span.SetAttributes(attribute.Bool("upload.skipped", true))
+	} else if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
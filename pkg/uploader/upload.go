@@ -0,0 +1,889 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"golang.org/x/exp/mmap"
+)
+
+// UploadFile uploads a single file under one of the sources to S3. It returns ErrSkipped
+// when SkipExisting is set and the object is already up to date, and an error matching
+// it when NoOverwrite or SkipUnreadable skips the file.
+func (u *Uploader) UploadFile(ctx context.Context, filePath string) error {
+	_, _, err := u.uploadFile(ctx, filePath)
+	return err
+}
+
+// uploadFile uploads a single file in its own span and returns its size and the
+// object's ETag, which is empty for skipped files and dry runs
+func (u *Uploader) uploadFile(ctx context.Context, filePath string) (int64, string, error) {
+	ctx, span := u.tracer.Start(ctx, "uploadFile", trace.WithAttributes(
+		attribute.String("s3.bucket", u.config.BucketName),
+		attribute.String("file.path", filePath)))
+	size, etag, err := u.transferFile(ctx, filePath)
+	if err != nil && !errors.Is(err, ErrSkipped) {
+		// Retry once if the bucket turned out to be in another region
+		if err = u.correctRegion(err); err == nil {
+			size, etag, err = u.transferFile(ctx, filePath)
+		}
+		err = checksumError(existsError(err))
+	}
+	if errors.Is(err, ErrObjectExists) {
+		u.logger.Debug("Skipping file whose key already exists", zap.String("file", filePath))
+	}
+	if s3Key, keyErr := u.s3Key(filePath); keyErr == nil {
+		span.SetAttributes(attribute.String("s3.key", s3Key))
+	}
+	span.SetAttributes(attribute.Int64("file.size", size))
+	endSpan(span, err)
+	return size, etag, err
+}
+
+// transferFile does the work of uploadFile
+func (u *Uploader) transferFile(ctx context.Context, filePath string) (int64, string, error) {
+	// Bound this file so one stuck transfer can't hold a worker forever
+	if u.fileTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, u.fileTimeout)
+		defer cancel()
+	}
+
+	// Open the file
+	file, err := os.Open(filePath)
+	if err != nil {
+		if u.skipUnreadable(filePath, err) {
+			return 0, "", ErrUnreadable
+		}
+		return 0, "", fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	// Determine S3 key
+	s3Key, err := u.s3Key(filePath)
+	if err != nil {
+		return 0, "", err
+	}
+	// Report a bad key clearly here rather than as whatever error S3 returns for it
+	warning, err := checkKey(s3Key)
+	if err != nil {
+		return 0, "", err
+	}
+	if warning != "" {
+		u.logger.Warn("Problematic S3 key",
+			zap.String("file", filePath),
+			zap.String("s3_key", s3Key),
+			zap.String("reason", warning))
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to stat file: %w", err)
+	}
+	size := info.Size()
+
+	var checksum string
+	if u.config.SkipExisting {
+		var unchanged bool
+		unchanged, checksum, err = u.isUnchanged(ctx, file, s3Key, size)
+		if err != nil {
+			return size, "", err
+		}
+		if unchanged {
+			u.logger.Debug("Skipping unchanged file",
+				zap.String("file", filePath),
+				zap.String("s3_key", s3Key))
+			remote := u.existing[s3Key]
+			u.manifest.add(ManifestEntry{Key: s3Key, Size: remote.Size, ETag: remote.ETag})
+			return size, "", ErrSkipped
+		}
+	}
+
+	if u.config.DryRun {
+		u.logger.Info("Dry run: would upload file",
+			zap.String("file", filePath),
+			zap.String("s3_key", s3Key),
+			zap.Int64("size", size))
+		return size, "", nil
+	}
+
+	input, err := u.objectInput(file, filePath, s3Key, info, checksum)
+	if err != nil {
+		return size, "", err
+	}
+
+	// The upload reads the content through data: the open file, or a mapping of it with UseMmap
+	var data io.ReaderAt = file
+	if u.config.UseMmap {
+		mapped, err := mmap.Open(filePath)
+		if err != nil {
+			u.logger.Debug("Could not memory-map file; reading it normally",
+				zap.String("file", filePath),
+				zap.Error(err))
+		} else {
+			defer mapped.Close()
+			data = mapped
+		}
+	}
+
+	_, relPath, err := u.relPath(filePath)
+	if err != nil {
+		return size, "", err
+	}
+	gzipped, err := u.shouldGzip(relPath)
+	if err != nil {
+		return size, "", err
+	}
+	// Set here rather than when compressing, so deduplicated copies carry it too
+	if gzipped {
+		input.ContentEncoding = aws.String("gzip")
+	}
+	send := func() (int64, string, error) {
+		return u.sendFile(ctx, filePath, file, data, input, size, gzipped)
+	}
+	if u.dedup != nil {
+		etag, err := u.sendDeduplicated(ctx, file, input, size, gzipped, send)
+		return size, etag, err
+	}
+	_, etag, err := send()
+	return size, etag, err
+}
+
+// sendFile uploads a file's content with the attributes in input, compressed or in parts
+// as configured, and returns the size stored in S3 and the object's ETag
+func (u *Uploader) sendFile(ctx context.Context, filePath string, file *os.File, data io.ReaderAt, input *s3.PutObjectInput, size int64, gzipped bool) (int64, string, error) {
+	if gzipped {
+		compressed, etag, err := u.uploadGzip(ctx, data, input, size)
+		if err != nil {
+			return 0, "", err
+		}
+		u.logger.Debug("Compressed file",
+			zap.String("file", filePath),
+			zap.Int64("size", size),
+			zap.Int64("compressed_size", compressed))
+		return compressed, etag, u.finishUpload(ctx, input, compressed, etag)
+	}
+
+	if u.config.VerifyIntegrity {
+		u.logger.Debug("Computing Content-MD5; the file is read once to hash and again to upload",
+			zap.String("file", filePath),
+			zap.Int64("size", size))
+	}
+
+	// Large files go through the multipart API
+	if size >= u.config.MultipartThreshold {
+		etag, err := u.uploadMultipart(ctx, data, input, size)
+		if err != nil {
+			return 0, "", err
+		}
+		return size, etag, u.finishUpload(ctx, input, size, etag)
+	}
+
+	if u.config.VerifyIntegrity {
+		checksum, err := contentMD5(io.NewSectionReader(file, 0, size))
+		if err != nil {
+			return 0, "", err
+		}
+		input.ContentMD5 = aws.String(checksum)
+	}
+
+	// Upload to S3
+	body := io.NewSectionReader(data, 0, size)
+	var out *s3.PutObjectOutput
+	err := u.withRetry(ctx, "PutObject", aws.ToString(input.Key), func() error {
+		// Rewind so a retried attempt sends the whole file again
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		input.Body = u.uploadBody(ctx, body)
+		var err error
+		out, err = u.client().PutObject(ctx, input)
+		return err
+	})
+
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to upload file: %w", err)
+	}
+
+	etag := trimETag(out.ETag)
+	return size, etag, u.finishUpload(ctx, input, size, etag)
+}
+
+// finishUpload verifies an uploaded object and adds it to the manifest
+func (u *Uploader) finishUpload(ctx context.Context, input *s3.PutObjectInput, size int64, etag string) error {
+	s3Key := aws.ToString(input.Key)
+	if err := u.verifyUpload(ctx, s3Key, size); err != nil {
+		return err
+	}
+	u.manifest.add(ManifestEntry{Key: s3Key, Size: size, ETag: etag, ContentType: aws.ToString(input.ContentType)})
+	return nil
+}
+
+// verifyUpload checks with HeadObject that the object at s3Key has the expected size.
+// It does nothing unless VerifyAfterUpload is set.
+func (u *Uploader) verifyUpload(ctx context.Context, s3Key string, size int64) error {
+	if !u.config.VerifyAfterUpload {
+		return nil
+	}
+
+	if err := u.requests.wait(ctx); err != nil {
+		return err
+	}
+	out, err := u.client().HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(u.config.BucketName),
+		RequestPayer: u.requestPayer(),
+		Key:          aws.String(s3Key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to verify upload: %w", err)
+	}
+	if remoteSize := aws.ToInt64(out.ContentLength); remoteSize != size {
+		return fmt.Errorf("uploaded object is %d bytes, expected %d", remoteSize, size)
+	}
+	return nil
+}
+
+// uploadFolderMarker uploads a zero-byte object whose key ends in "/" for an empty directory
+func (u *Uploader) uploadFolderMarker(ctx context.Context, dirPath string) error {
+	s3Key, err := u.baseKey(dirPath)
+	if err != nil {
+		return err
+	}
+	s3Key += "/"
+
+	if u.config.SkipExisting {
+		if _, ok := u.existing[s3Key]; ok {
+			u.logger.Debug("Skipping existing folder marker", zap.String("s3_key", s3Key))
+			return ErrSkipped
+		}
+	}
+
+	if u.config.DryRun {
+		u.logger.Info("Dry run: would create folder marker",
+			zap.String("dir", dirPath),
+			zap.String("s3_key", s3Key))
+		return nil
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:        aws.String(u.config.BucketName),
+		RequestPayer:  u.requestPayer(),
+		Key:           aws.String(s3Key),
+		ContentType:   aws.String("application/x-directory"),
+		ContentLength: aws.Int64(0),
+	}
+	if u.config.NoOverwrite {
+		input.IfNoneMatch = aws.String("*")
+	}
+	if u.config.ServerSideEncryption != "" {
+		input.ServerSideEncryption = types.ServerSideEncryption(u.config.ServerSideEncryption)
+	}
+	if u.config.KMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(u.config.KMSKeyID)
+	}
+
+	err = u.withRetry(ctx, "PutObject", s3Key, func() error {
+		input.Body = bytes.NewReader(nil)
+		_, err := u.client().PutObject(ctx, input)
+		return err
+	})
+	if err = existsError(err); errors.Is(err, ErrObjectExists) {
+		u.logger.Debug("Skipping existing folder marker", zap.String("s3_key", s3Key))
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create folder marker: %w", err)
+	}
+	return nil
+}
+
+// objectInput builds the PutObject request for a file, carrying every object attribute
+// (content type, metadata, ...) so the multipart path can copy them from it. checksum is
+// the file's SHA-256 if it was already computed, or "".
+func (u *Uploader) objectInput(file *os.File, filePath, s3Key string, info os.FileInfo, checksum string) (*s3.PutObjectInput, error) {
+	input := &s3.PutObjectInput{
+		Bucket:       aws.String(u.config.BucketName),
+		RequestPayer: u.requestPayer(),
+		Key:          aws.String(s3Key),
+		Metadata:     make(map[string]string),
+	}
+	if u.config.NoOverwrite {
+		input.IfNoneMatch = aws.String("*")
+	}
+
+	if aws.ToBool(u.config.DetectContentType) {
+		input.ContentType = aws.String(u.contentType(file, filePath))
+	}
+
+	if u.config.PreserveMtime {
+		input.Metadata[MetadataMtime] = info.ModTime().UTC().Format(time.RFC3339Nano)
+	}
+	if u.config.PreservePermissions {
+		input.Metadata[MetadataMode] = fmt.Sprintf("%04o", info.Mode().Perm())
+	}
+
+	_, relPath, err := u.relPath(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.config.StoreOriginalPath {
+		// Metadata must be ASCII; S3 expects RFC 2047 encoding for anything else
+		input.Metadata[MetadataOriginalPath] = mime.QEncoding.Encode("utf-8", relPath)
+	}
+
+	// Metadata is sent before the body, so the file is hashed in a pass of its own unless
+	// SyncModeHash already did so to compare it
+	if u.config.StoreChecksum || u.config.SyncMode == SyncModeHash {
+		if checksum == "" {
+			if checksum, err = fileSHA256(io.NewSectionReader(file, 0, info.Size())); err != nil {
+				return nil, err
+			}
+		}
+		input.Metadata[MetadataSHA256] = checksum
+		u.logger.Debug("Computed SHA-256",
+			zap.String("file", filePath),
+			zap.String("sha256", checksum))
+	}
+
+	if u.config.ACL != "" {
+		input.ACL = types.ObjectCannedACL(u.config.ACL)
+	}
+
+	cacheControl, contentDisposition, err := u.headers(relPath)
+	if err != nil {
+		return nil, err
+	}
+	if cacheControl != "" {
+		input.CacheControl = aws.String(cacheControl)
+	}
+	if contentDisposition != "" {
+		input.ContentDisposition = aws.String(contentDisposition)
+	}
+
+	storageClass, err := u.storageClass(relPath)
+	if err != nil {
+		return nil, err
+	}
+	if storageClass != "" {
+		input.StorageClass = types.StorageClass(storageClass)
+	}
+
+	sidecar, err := u.readSidecar(filePath)
+	if err != nil {
+		return nil, err
+	}
+	var sidecarTags map[string]string
+	if sidecar != nil {
+		if sidecar.ContentType != "" {
+			input.ContentType = aws.String(sidecar.ContentType)
+		}
+		for key, value := range sidecar.Metadata {
+			input.Metadata[key] = mime.QEncoding.Encode("utf-8", value)
+		}
+		sidecarTags = sidecar.Tags
+	}
+
+	tagging, err := u.objectTagging(relPath, sidecarTags)
+	if err != nil {
+		return nil, err
+	}
+	if tagging != "" {
+		input.Tagging = aws.String(tagging)
+	}
+
+	if u.config.ServerSideEncryption != "" {
+		input.ServerSideEncryption = types.ServerSideEncryption(u.config.ServerSideEncryption)
+	}
+	if u.config.KMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(u.config.KMSKeyID)
+	}
+
+	if u.config.ChecksumAlgorithm != "" {
+		input.ChecksumAlgorithm = types.ChecksumAlgorithm(u.config.ChecksumAlgorithm)
+	}
+
+	if u.config.ObjectLockMode != "" {
+		input.ObjectLockMode = types.ObjectLockMode(u.config.ObjectLockMode)
+		input.ObjectLockRetainUntilDate = aws.Time(u.lockRetainUntil())
+	}
+
+	return input, nil
+}
+
+// lockRetainUntil returns the Object Lock retain-until date for an object written now
+func (u *Uploader) lockRetainUntil() time.Time {
+	if u.retainFor > 0 {
+		return time.Now().Add(u.retainFor).UTC()
+	}
+	return u.retainUntil
+}
+
+// headers returns the Cache-Control and Content-Disposition values for a file from the
+// first matching header rule, falling back to CacheControl and ContentDisposition
+func (u *Uploader) headers(relPath string) (cacheControl, contentDisposition string, err error) {
+	cacheControl, contentDisposition = u.config.CacheControl, u.config.ContentDisposition
+	for _, rule := range u.config.HeaderRules {
+		matched, err := u.matchPattern(rule.Pattern, relPath)
+		if err != nil {
+			return "", "", err
+		}
+		if !matched {
+			continue
+		}
+		if rule.CacheControl != "" {
+			cacheControl = rule.CacheControl
+		}
+		if rule.ContentDisposition != "" {
+			contentDisposition = rule.ContentDisposition
+		}
+		break
+	}
+	return cacheControl, contentDisposition, nil
+}
+
+// storageClass returns the storage class for a file from the first matching rule,
+// falling back to StorageClass
+func (u *Uploader) storageClass(relPath string) (string, error) {
+	for _, rule := range u.config.StorageClassRules {
+		matched, err := u.matchPattern(rule.Pattern, relPath)
+		if err != nil {
+			return "", err
+		}
+		if matched {
+			return rule.StorageClass, nil
+		}
+	}
+	return u.config.StorageClass, nil
+}
+
+// s3Key computes the S3 key for a local file, including the gzip extension when
+// the file is compressed
+func (u *Uploader) s3Key(filePath string) (string, error) {
+	s3Key, err := u.baseKey(filePath)
+	if err != nil {
+		return "", err
+	}
+
+	_, relPath, err := u.relPath(filePath)
+	if err != nil {
+		return "", err
+	}
+	gzipped, err := u.shouldGzip(relPath)
+	if err != nil {
+		return "", err
+	}
+	if gzipped {
+		s3Key += aws.ToString(u.config.GzipExtension)
+	}
+	if u.config.SanitizeKeys && len(s3Key) > maxKeyBytes {
+		s3Key = shortenKey(s3Key)
+	}
+	return s3Key, nil
+}
+
+// relPath returns the source filePath belongs to and the path relative to it, with forward slashes
+func (u *Uploader) relPath(filePath string) (*source, string, error) {
+	src := u.sourceFor(filePath)
+	if src == nil {
+		return nil, "", fmt.Errorf("%s is not under any source path", filePath)
+	}
+	relPath, err := filepath.Rel(src.root, filePath)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to determine relative path: %w", err)
+	}
+	return src, filepath.ToSlash(relPath), nil
+}
+
+// baseKey computes the S3 key for a local path from its source's prefix and its path
+// relative to the source, or from KeyTemplate when one is set. LowercaseKeys only
+// applies to the part after the prefix, so the configured prefixes are kept as they are.
+func (u *Uploader) baseKey(filePath string) (string, error) {
+	src, relPath, err := u.relPath(filePath)
+	if err != nil {
+		return "", err
+	}
+	return u.keyFor(src.prefix, relPath)
+}
+
+// keyFor applies StripPrefix, Flatten, KeyTemplate, LowercaseKeys and SanitizeKeys to
+// a slash-separated relative path and joins the result to prefix
+func (u *Uploader) keyFor(prefix, relPath string) (string, error) {
+	var err error
+	relPath, _ = u.stripRel(relPath)
+
+	if u.config.Flatten {
+		relPath = path.Base(relPath)
+	}
+
+	if u.keyTemplate != nil {
+		if relPath, err = u.templateKey(relPath); err != nil {
+			return "", err
+		}
+	}
+
+	if u.config.LowercaseKeys {
+		relPath = strings.ToLower(relPath)
+	}
+	if u.config.SanitizeKeys {
+		relPath = sanitizeKeyPart(relPath)
+	}
+	return filepath.Join(prefix, relPath), nil
+}
+
+// contentType determines the MIME type of a file from overrides, the mime map file,
+// its extension or its content
+func (u *Uploader) contentType(file *os.File, filePath string) string {
+	ext := strings.ToLower(filepath.Ext(filePath))
+
+	if contentType, ok := u.config.ContentTypeOverrides[ext]; ok {
+		return contentType
+	}
+
+	if contentType, ok := u.mimeMap[ext]; ok {
+		return contentType
+	}
+
+	if contentType := mime.TypeByExtension(ext); contentType != "" {
+		return contentType
+	}
+
+	// Fall back to sniffing the first 512 bytes; ReadAt leaves the file offset untouched
+	buf := make([]byte, 512)
+	n, err := file.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return "application/octet-stream"
+	}
+	return http.DetectContentType(buf[:n])
+}
+
+// loadMimeMap reads a JSON object mapping extensions, with or without the leading dot,
+// to content types
+func loadMimeMap(filePath string) (map[string]string, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	mimeMap := make(map[string]string, len(raw))
+	for ext, contentType := range raw {
+		if _, _, err := mime.ParseMediaType(contentType); err != nil {
+			return nil, fmt.Errorf("invalid content type for %q: %w", ext, err)
+		}
+		mimeMap["."+strings.TrimPrefix(strings.ToLower(ext), ".")] = contentType
+	}
+	return mimeMap, nil
+}
+
+// uploadMultipart uploads a file in parts, PartConcurrency at a time, returning the ETag,
+// and aborts the upload if any step fails. Object attributes are taken from input so both
+// upload paths produce the same object.
+func (u *Uploader) uploadMultipart(ctx context.Context, file io.ReaderAt, input *s3.PutObjectInput, size int64) (string, error) {
+	s3Key := aws.ToString(input.Key)
+	uploadID, err := u.createMultipart(ctx, input)
+	if err != nil {
+		return "", err
+	}
+
+	partSize := u.partSizeFor(size)
+	group := u.newPartGroup(ctx, s3Key, uploadID)
+	for offset, partNumber := int64(0), int32(1); offset < size; offset, partNumber = offset+partSize, partNumber+1 {
+		// Sections read with ReadAt, so parts can share the file
+		length := min(partSize, size-offset)
+		if !group.add(partNumber, io.NewSectionReader(file, offset, length), nil) {
+			break
+		}
+	}
+
+	parts, err := group.wait()
+	if err != nil {
+		u.abortMultipart(s3Key, uploadID)
+		return "", err
+	}
+	return u.completeMultipart(ctx, s3Key, uploadID, parts)
+}
+
+// partGroup uploads the parts of one multipart upload, PartConcurrency at a time.
+// The first part to fail stops the others.
+type partGroup struct {
+	u        *Uploader
+	s3Key    string
+	uploadID *string
+	parent   context.Context
+	ctx      context.Context // Cancelled when a part fails
+	cancel   context.CancelFunc
+	slots    chan struct{}
+	wg       sync.WaitGroup
+
+	mu    sync.Mutex
+	parts []types.CompletedPart // By part number - 1
+	err   error                 // The first part error
+}
+
+// newPartGroup starts a group for the parts of the multipart upload uploadID
+func (u *Uploader) newPartGroup(ctx context.Context, s3Key string, uploadID *string) *partGroup {
+	partCtx, cancel := context.WithCancel(ctx)
+	return &partGroup{
+		u:        u,
+		s3Key:    s3Key,
+		uploadID: uploadID,
+		parent:   ctx,
+		ctx:      partCtx,
+		cancel:   cancel,
+		slots:    make(chan struct{}, u.config.PartConcurrency),
+	}
+}
+
+// add waits for a free slot and then uploads body as partNumber in the background,
+// calling done, if not nil, when the part has finished. Once a part has failed or ctx
+// is done it uploads nothing, calls done right away and returns false.
+func (g *partGroup) add(partNumber int32, body *io.SectionReader, done func()) bool {
+	select {
+	case g.slots <- struct{}{}:
+	case <-g.ctx.Done():
+	}
+	if g.ctx.Err() != nil {
+		if done != nil {
+			done()
+		}
+		return false
+	}
+
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		defer func() { <-g.slots }()
+		if done != nil {
+			defer done()
+		}
+
+		part, err := g.u.uploadPart(g.ctx, g.s3Key, g.uploadID, partNumber, body)
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if err != nil {
+			if g.err == nil {
+				g.err = err
+				g.cancel()
+			}
+			return
+		}
+		for len(g.parts) < int(partNumber) {
+			g.parts = append(g.parts, types.CompletedPart{})
+		}
+		g.parts[partNumber-1] = part
+	}()
+	return true
+}
+
+// wait waits for the parts added so far and returns them in order, or the first part
+// error, or the error of the upload's context. The caller aborts the upload on error.
+func (g *partGroup) wait() ([]types.CompletedPart, error) {
+	g.wg.Wait()
+	g.cancel()
+	if g.err != nil {
+		return nil, g.err
+	}
+	if err := g.parent.Err(); err != nil {
+		return nil, err
+	}
+	return g.parts, nil
+}
+
+// createMultipart starts a multipart upload with the object attributes from input
+func (u *Uploader) createMultipart(ctx context.Context, input *s3.PutObjectInput) (*string, error) {
+	if err := u.requests.wait(ctx); err != nil {
+		return nil, err
+	}
+	created, err := u.client().CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:             input.Bucket,
+		RequestPayer:       u.requestPayer(),
+		Key:                input.Key,
+		ContentType:        input.ContentType,
+		ContentEncoding:    input.ContentEncoding,
+		CacheControl:       input.CacheControl,
+		ContentDisposition: input.ContentDisposition,
+		Metadata:           input.Metadata,
+		ACL:                input.ACL,
+
+		StorageClass:         input.StorageClass,
+		Tagging:              input.Tagging,
+		ServerSideEncryption: input.ServerSideEncryption,
+		SSEKMSKeyId:          input.SSEKMSKeyId,
+		ChecksumAlgorithm:    input.ChecksumAlgorithm,
+
+		ObjectLockMode:            input.ObjectLockMode,
+		ObjectLockRetainUntilDate: input.ObjectLockRetainUntilDate,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create multipart upload: %w", err)
+	}
+	return created.UploadId, nil
+}
+
+// uploadPart uploads one part, retrying transient errors. The caller aborts the upload on failure.
+func (u *Uploader) uploadPart(ctx context.Context, s3Key string, uploadID *string, partNumber int32, body *io.SectionReader) (types.CompletedPart, error) {
+	// Each part carries its own MD5 so S3 can reject a corrupted part
+	var checksum *string
+	if u.config.VerifyIntegrity {
+		sum, err := contentMD5(io.NewSectionReader(body, 0, body.Size()))
+		if err != nil {
+			return types.CompletedPart{}, err
+		}
+		checksum = aws.String(sum)
+	}
+
+	var out *s3.UploadPartOutput
+	err := u.withRetry(ctx, "UploadPart", s3Key, func() error {
+		// Rewind so a retried attempt sends the whole part again
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		var err error
+		out, err = u.client().UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:            aws.String(u.config.BucketName),
+			RequestPayer:      u.requestPayer(),
+			Key:               aws.String(s3Key),
+			UploadId:          uploadID,
+			PartNumber:        aws.Int32(partNumber),
+			Body:              u.uploadBody(ctx, body),
+			ContentLength:     aws.Int64(body.Size()),
+			ContentMD5:        checksum,
+			ChecksumAlgorithm: types.ChecksumAlgorithm(u.config.ChecksumAlgorithm),
+		})
+		return err
+	})
+	if err != nil {
+		return types.CompletedPart{}, fmt.Errorf("failed to upload part %d: %w", partNumber, err)
+	}
+
+	// Completing the upload needs each part's checksum when ChecksumAlgorithm is set
+	return types.CompletedPart{
+		ETag:           out.ETag,
+		PartNumber:     aws.Int32(partNumber),
+		ChecksumCRC32:  out.ChecksumCRC32,
+		ChecksumCRC32C: out.ChecksumCRC32C,
+		ChecksumSHA1:   out.ChecksumSHA1,
+		ChecksumSHA256: out.ChecksumSHA256,
+	}, nil
+}
+
+// completeMultipart completes a multipart upload and returns the ETag, aborting the upload if that fails
+func (u *Uploader) completeMultipart(ctx context.Context, s3Key string, uploadID *string, parts []types.CompletedPart) (string, error) {
+	input := &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(u.config.BucketName),
+		RequestPayer:    u.requestPayer(),
+		Key:             aws.String(s3Key),
+		UploadId:        uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	}
+	// S3 only checks the condition once the parts are in
+	if u.config.NoOverwrite {
+		input.IfNoneMatch = aws.String("*")
+	}
+	if err := u.requests.wait(ctx); err != nil {
+		u.abortMultipart(s3Key, uploadID)
+		return "", err
+	}
+	out, err := u.client().CompleteMultipartUpload(ctx, input)
+	if err != nil {
+		u.abortMultipart(s3Key, uploadID)
+		return "", fmt.Errorf("failed to complete multipart upload: %w", err)
+	}
+
+	return trimETag(out.ETag), nil
+}
+
+// contentMD5 returns the base64-encoded MD5 of r, as expected by the Content-MD5 header
+func contentMD5(r io.Reader) (string, error) {
+	hash := md5.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", fmt.Errorf("failed to hash file: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(hash.Sum(nil)), nil
+}
+
+// checksumErrorCodes are the S3 error codes for data that doesn't match the checksum sent with it
+var checksumErrorCodes = map[string]bool{
+	"BadDigest":                   true,
+	"InvalidDigest":               true,
+	"XAmzContentChecksumMismatch": true,
+	"XAmzContentSHA256Mismatch":   true,
+}
+
+// checksumError explains a checksum mismatch reported by S3, returning other errors as is
+func checksumError(err error) error {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && checksumErrorCodes[apiErr.ErrorCode()] {
+		return fmt.Errorf("checksum mismatch: S3 received different data than was read from the file, "+
+			"which was corrupted in transit or changed while uploading: %w", err)
+	}
+	return err
+}
+
+// fileSHA256 returns the hex-encoded SHA-256 of r
+func fileSHA256(r io.Reader) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", fmt.Errorf("failed to hash file: %w", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// abortMultipart aborts a multipart upload so its parts don't keep accruing storage charges
+func (u *Uploader) abortMultipart(s3Key string, uploadID *string) {
+	// Use a fresh context so the abort still goes out when the upload context was cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	err := u.requests.wait(ctx)
+	if err == nil {
+		_, err = u.client().AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:       aws.String(u.config.BucketName),
+			RequestPayer: u.requestPayer(),
+			Key:          aws.String(s3Key),
+			UploadId:     uploadID,
+		})
+	}
+	if err != nil {
+		u.logger.Warn("Failed to abort multipart upload",
+			zap.String("s3_key", s3Key),
+			zap.String("upload_id", aws.ToString(uploadID)),
+			zap.Error(err))
+	}
+}
+
+// partSizeFor returns the configured part size, grown if needed to stay within the part limit
+func (u *Uploader) partSizeFor(size int64) int64 {
+	partSize := u.config.PartSize
+	if minSize := (size + maxParts - 1) / maxParts; minSize > partSize {
+		partSize = minSize
+	}
+	return partSize
+}
@@ -0,0 +1,206 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestUploader returns an uploader for dir that sends its requests to a new fakeS3.
+// configure, if not nil, can change the config before it is validated.
+func newTestUploader(t testing.TB, dir string, configure func(*Config)) (*Uploader, *fakeS3) {
+	t.Helper()
+	cfg := &Config{
+		BucketName:     "test-bucket",
+		Region:         "us-east-1",
+		LocalPath:      dir,
+		S3Prefix:       "backup",
+		LogLevel:       "error",
+		RetryBaseDelay: "1ms",
+	}
+	if configure != nil {
+		configure(cfg)
+	}
+
+	client := newFakeS3()
+	u, err := NewUploaderWithClient(cfg, client)
+	if err != nil {
+		t.Fatalf("NewUploaderWithClient: %v", err)
+	}
+	return u, client
+}
+
+// writeTestFile creates a file of the given size with non-repeating content in dir
+func writeTestFile(t testing.TB, dir, name string, size int) (string, []byte) {
+	t.Helper()
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i*7 + i/251)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path, data
+}
+
+func TestUploadFile(t *testing.T) {
+	dir := t.TempDir()
+	path, data := writeTestFile(t, dir, "report.csv", 1024)
+	u, client := newTestUploader(t, dir, nil)
+
+	if err := u.UploadFile(context.Background(), path); err != nil {
+		t.Fatalf("UploadFile: %v", err)
+	}
+
+	got, ok := client.object("backup/report.csv")
+	if !ok {
+		t.Fatal("object backup/report.csv was not stored")
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("stored %d bytes that differ from the %d bytes of the file", len(got), len(data))
+	}
+	if n := client.callCount("CreateMultipartUpload"); n != 0 {
+		t.Errorf("small file started %d multipart uploads", n)
+	}
+}
+
+func TestUploadFileMultipart(t *testing.T) {
+	dir := t.TempDir()
+	path, data := writeTestFile(t, dir, "large.bin", int(2*minPartSize+1024))
+	u, client := newTestUploader(t, dir, func(cfg *Config) {
+		cfg.MultipartThreshold = minPartSize
+		cfg.PartSize = minPartSize
+		cfg.PartConcurrency = 2
+	})
+
+	if err := u.UploadFile(context.Background(), path); err != nil {
+		t.Fatalf("UploadFile: %v", err)
+	}
+
+	got, ok := client.object("backup/large.bin")
+	if !ok {
+		t.Fatal("object backup/large.bin was not stored")
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("parts were not reassembled into the file's content")
+	}
+	if n := client.callCount("UploadPart"); n != 3 {
+		t.Errorf("uploaded %d parts, want 3", n)
+	}
+}
+
+func TestUploadFileAbortsFailedMultipart(t *testing.T) {
+	dir := t.TempDir()
+	path, _ := writeTestFile(t, dir, "large.bin", int(2*minPartSize+1024))
+	u, client := newTestUploader(t, dir, func(cfg *Config) {
+		cfg.MultipartThreshold = minPartSize
+		cfg.PartSize = minPartSize
+	})
+	client.failNext("UploadPart", nil, apiError("AccessDenied"))
+
+	err := u.UploadFile(context.Background(), path)
+	if err == nil {
+		t.Fatal("UploadFile succeeded although a part failed")
+	}
+
+	if len(client.aborted) != 1 {
+		t.Fatalf("aborted %d multipart uploads, want 1", len(client.aborted))
+	}
+	if len(client.uploads) != 0 {
+		t.Errorf("%d multipart uploads were left behind", len(client.uploads))
+	}
+	if _, ok := client.object("backup/large.bin"); ok {
+		t.Error("object was stored although the upload failed")
+	}
+	if n := client.callCount("CompleteMultipartUpload"); n != 0 {
+		t.Errorf("CompleteMultipartUpload was called %d times", n)
+	}
+}
+
+func TestUploadFileRetriesTransientErrors(t *testing.T) {
+	dir := t.TempDir()
+	path, data := writeTestFile(t, dir, "report.csv", 1024)
+	u, client := newTestUploader(t, dir, nil)
+	client.failNext("PutObject", apiError("SlowDown"), apiError("InternalError"))
+
+	if err := u.UploadFile(context.Background(), path); err != nil {
+		t.Fatalf("UploadFile: %v", err)
+	}
+
+	if n := client.callCount("PutObject"); n != 3 {
+		t.Errorf("PutObject was called %d times, want 3", n)
+	}
+	if got, _ := client.object("backup/report.csv"); !bytes.Equal(got, data) {
+		t.Error("retried upload stored the wrong content")
+	}
+}
+
+func TestUploadFileGivesUpAfterMaxRetries(t *testing.T) {
+	dir := t.TempDir()
+	path, _ := writeTestFile(t, dir, "report.csv", 1024)
+	u, client := newTestUploader(t, dir, func(cfg *Config) {
+		cfg.MaxRetries = 2
+	})
+	slowDown := apiError("SlowDown")
+	client.failNext("PutObject", slowDown, slowDown, slowDown, slowDown)
+
+	err := u.UploadFile(context.Background(), path)
+	if !errors.Is(err, slowDown) {
+		t.Fatalf("UploadFile returned %v, want the last SlowDown error", err)
+	}
+	if n := client.callCount("PutObject"); n != 3 {
+		t.Errorf("PutObject was called %d times, want 3", n)
+	}
+}
+
+func TestUploadFileDoesNotRetryPermanentErrors(t *testing.T) {
+	dir := t.TempDir()
+	path, _ := writeTestFile(t, dir, "report.csv", 1024)
+	u, client := newTestUploader(t, dir, nil)
+	client.failNext("PutObject", apiError("AccessDenied"))
+
+	if err := u.UploadFile(context.Background(), path); err == nil {
+		t.Fatal("UploadFile succeeded although PutObject was denied")
+	}
+	if n := client.callCount("PutObject"); n != 1 {
+		t.Errorf("PutObject was called %d times, want 1", n)
+	}
+}
+
+// BenchmarkUploadFile compares reading a multipart file normally with memory-mapping
+// it (use_mmap). The fake discards what it receives, so the allocations reported are
+// the uploader's own.
+func BenchmarkUploadFile(b *testing.B) {
+	dir := b.TempDir()
+	size := int(4*minPartSize + 1024)
+	path, _ := writeTestFile(b, dir, "large.bin", size)
+
+	for _, mmap := range []bool{false, true} {
+		name := "read"
+		if mmap {
+			name = "mmap"
+		}
+		b.Run(name, func(b *testing.B) {
+			u, client := newTestUploader(b, dir, func(cfg *Config) {
+				cfg.MultipartThreshold = minPartSize
+				cfg.PartSize = minPartSize
+				cfg.PartConcurrency = 4
+				cfg.UseMmap = mmap
+			})
+			client.discardBodies = true
+
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := u.UploadFile(context.Background(), path); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
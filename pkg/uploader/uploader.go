@@ -0,0 +1,1320 @@
+// Package uploader uploads local files to Amazon S3 and S3-compatible services.
+//
+// Load a Config with LoadConfig (or build one in code), create an Uploader
+// with NewUploader and call Upload:
+//
+//	cfg, err := uploader.LoadConfig("config.json")
+//	if err != nil {
+//		return err
+//	}
+//	u, err := uploader.NewUploader(cfg)
+//	if err != nil {
+//		return err
+//	}
+//	return u.Upload()
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bmatcuk/doublestar/v4"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+// Uploader handles the S3 upload process
+type Uploader struct {
+	// clientMu guards s3Client, presigner and config.Region, which are replaced if the
+	// region is corrected mid-run
+	clientMu        sync.RWMutex
+	s3Client        S3API
+	presigner       *s3.PresignClient // Set when GeneratePresignedURLs is enabled
+	regionCorrected bool              // Set once an upload has switched the region, so it happens at most once
+
+	presignExpiry  time.Duration
+	config         *Config
+	logger         *zap.Logger
+	retryBaseDelay time.Duration
+	runRetryDelay  time.Duration
+	timeout        time.Duration
+	fileTimeout    time.Duration // Zero means no per-file limit
+	limiter        *rate.Limiter // Shared by all workers; nil when MaxBandwidth is unset
+	expectedRate   int64         // ExpectedThroughput, or MaxBandwidth, in bytes per second; zero when unknown
+	runID          string        // Identifies this run in tags such as source-run-id={run_id}
+	startTime      time.Time
+	keyTemplate    *template.Template // Parsed KeyTemplate; nil when unset
+	minSize        int64              // Parsed MinSize; zero means no lower bound
+	maxSize        int64              // Parsed MaxSize; zero means no upper bound
+	modifiedAfter  time.Time          // Parsed ModifiedAfter; zero means no lower bound
+	modifiedBefore time.Time          // Parsed ModifiedBefore; zero means no upper bound
+	retainUntil    time.Time          // ObjectLockRetainUntil when it is a time
+	retainFor      time.Duration      // ObjectLockRetainUntil when it is a duration
+
+	// partBuffers holds released PartSize buffers for compressed parts; see partBuffer
+	partBuffers sync.Pool
+
+	// unreadable lists the paths skipped for lack of read permission; see skipUnreadable
+	unreadableMu sync.Mutex
+	unreadable   []string
+
+	// existing maps S3 keys already in the bucket to their size and ETag when SkipExisting is set
+	existing map[string]remoteObject
+
+	// sources are the validated LocalPath and Sources entries, in config order
+	sources []source
+
+	// ignore holds the rules parsed from IgnoreFile, if set
+	ignore *ignoreMatcher
+
+	// mimeMap holds the content types from MimeMapFile by lowercase extension, if set
+	mimeMap map[string]string
+
+	// state tracks completed uploads when StateFile is set
+	state *uploadState
+
+	// dedup records uploaded content by hash when DedupByHash is set
+	dedup *dedupIndex
+
+	// replicas upload every file to the Buckets targets as well; primaryCounts counts
+	// the outcomes in BucketName alongside theirs
+	replicas      []*replica
+	primaryCounts targetCounts
+
+	// targetErrs holds the outcome in each bucket, primary first, of the files that
+	// failed in any of them, so a retry only sends them to the buckets that failed
+	targetErrsMu sync.Mutex
+	targetErrs   map[string][]error
+
+	// manifest collects uploaded objects when GenerateManifest is set
+	manifest *manifest
+
+	// events records each finished file while a run with EventLog set is in progress
+	events *eventLog
+
+	// metrics exports Prometheus metrics when MetricsAddr is set
+	metrics *metrics
+
+	// requests spaces out S3 requests when MaxRequestsPerSecond is set
+	requests *requestLimiter
+
+	// tracer creates the run and per-file spans; a no-op unless OTLPEndpoint is set,
+	// in which case tracerProvider exports them
+	tracer         trace.Tracer
+	tracerProvider *sdktrace.TracerProvider
+
+	// bytesUploaded totals the size of successfully uploaded files, updated atomically by workers
+	bytesUploaded int64
+
+	// localFilesDeleted counts files removed by DeleteAfterUpload, updated atomically by workers
+	localFilesDeleted int64
+
+	// throttleEvents counts throttling errors from S3, updated atomically; used by adaptive concurrency
+	throttleEvents int64
+}
+
+// fileResult is the outcome of uploading a single file
+type fileResult struct {
+	File     LocalFile
+	Size     int64
+	Duration time.Duration
+	URL      *PresignedURL // Set when GeneratePresignedURLs is enabled
+	Err      error
+}
+
+// NewUploader creates a new S3 uploader with validation.
+// Invalid configuration is reported as a *ConfigError.
+func NewUploader(cfg *Config) (*Uploader, error) {
+	u, err := newUploader(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// The client only fails to build on bad AWS settings, such as an unknown profile
+	s3Client, err := newS3Client(cfg)
+	if err != nil {
+		return nil, &ConfigError{Field: "aws", Message: "settings could not be loaded", Err: err}
+	}
+	u.setClient(s3Client)
+
+	err = u.addReplicas(func(cfg *Config) (S3API, error) {
+		return newS3Client(cfg)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// NewUploaderWithClient creates an uploader that sends all S3 requests through client
+// instead of building one from the AWS settings in cfg. This lets tests inject a mock.
+func NewUploaderWithClient(cfg *Config, client S3API) (*Uploader, error) {
+	u, err := newUploader(cfg)
+	if err != nil {
+		return nil, err
+	}
+	u.setClient(client)
+
+	// Every bucket goes through the same client
+	err = u.addReplicas(func(*Config) (S3API, error) {
+		return client, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// newUploader validates cfg and sets up everything except the S3 client
+func newUploader(cfg *Config) (*Uploader, error) {
+	cfg.applyDefaults()
+
+	// Every problem is collected so they can all be fixed in one go
+	var errs ConfigErrors
+
+	// Validate required fields
+	if cfg.BucketName == "" {
+		errs.add(&ConfigError{Field: "bucket_name", Message: "is required in config"})
+	}
+
+	// Verify the sources exist; a single file is uploaded under its base name. A move
+	// happens entirely within the bucket, so it has no local sources.
+	var sources []source
+	var err error
+	if cfg.Mode != ModeMove {
+		sources, err = newSources(cfg)
+		errs.add(err)
+	}
+
+	if cfg.SessionToken != "" && (cfg.AccessKey == "" || cfg.SecretKey == "") {
+		errs.add(&ConfigError{Field: "session_token", Message: "requires access_key and secret_key to be set"})
+	}
+
+	if cfg.AssumeRoleARN != "" && !strings.HasPrefix(cfg.AssumeRoleARN, "arn:") {
+		errs.add(&ConfigError{Field: "assume_role_arn", Message: fmt.Sprintf("must be a role ARN: %q", cfg.AssumeRoleARN)})
+	}
+
+	if cfg.AssumeRoleARN == "" && (cfg.ExternalID != "" || cfg.SessionName != "") {
+		errs.add(&ConfigError{Field: "assume_role_arn", Message: "is required when external_id or role_session_name is set"})
+	}
+
+	if cfg.PartSize < minPartSize {
+		errs.add(&ConfigError{Field: "part_size", Message: fmt.Sprintf("must be at least %d bytes", minPartSize)})
+	}
+
+	retryBaseDelay, err := parseDuration("retry_base_delay", cfg.RetryBaseDelay, defaultRetryBaseDelay)
+	errs.add(err)
+
+	if cfg.SDKMaxAttempts < 0 {
+		errs.add(&ConfigError{Field: "sdk_max_attempts", Message: "must not be negative"})
+	}
+
+	_, err = parseDuration("sdk_max_backoff", cfg.SDKMaxBackoff, 0)
+	errs.add(err)
+
+	if cfg.RunRetries < 0 {
+		errs.add(&ConfigError{Field: "run_retries", Message: "must not be negative"})
+	}
+
+	runRetryDelay, err := parseDuration("run_retry_delay", cfg.RunRetryDelay, defaultRunRetryDelay)
+	errs.add(err)
+
+	timeout, err := parseDuration("timeout", cfg.Timeout, defaultTimeout)
+	errs.add(err)
+
+	fileTimeout, err := parseDuration("file_timeout", cfg.FileTimeout, 0)
+	errs.add(err)
+
+	if cfg.MaxIdleConnsPerHost < 0 {
+		errs.add(&ConfigError{Field: "max_idle_conns_per_host", Message: "must not be negative"})
+	}
+	if cfg.MaxIdleConns < 0 {
+		errs.add(&ConfigError{Field: "max_idle_conns", Message: "must not be negative"})
+	}
+	_, err = parseDuration("idle_conn_timeout", cfg.IdleConnTimeout, 0)
+	errs.add(err)
+
+	presignExpiry, err := parseDuration("presign_expiry", cfg.PresignExpiry, defaultPresignExpiry)
+	errs.add(err)
+	if presignExpiry > maxPresignExpiry {
+		errs.add(&ConfigError{Field: "presign_expiry", Message: fmt.Sprintf("must be at most %s: %q", maxPresignExpiry, cfg.PresignExpiry)})
+	}
+
+	var keyTemplate *template.Template
+	if cfg.KeyTemplate != "" {
+		if keyTemplate, err = parseKeyTemplate(cfg.KeyTemplate); err != nil {
+			errs.add(&ConfigError{Field: "key_template", Message: "is not a valid template", Err: err})
+		}
+	}
+
+	if cfg.CreateFolderMarkers && (cfg.Flatten || cfg.KeyTemplate != "") {
+		errs.add(&ConfigError{Field: "create_folder_markers", Message: "cannot be combined with flatten or key_template"})
+	}
+
+	switch cfg.UploadOrder {
+	case "", UploadOrderNone, UploadOrderLargestFirst, UploadOrderSmallestFirst, UploadOrderAlpha:
+	default:
+		errs.add(&ConfigError{Field: "upload_order", Message: fmt.Sprintf("must be %q, %q, %q or %q: %q",
+			UploadOrderLargestFirst, UploadOrderSmallestFirst, UploadOrderAlpha, UploadOrderNone, cfg.UploadOrder)})
+	}
+
+	if strip := filepath.ToSlash(cfg.StripPrefix); strip != "" {
+		if strings.HasPrefix(strip, "/") || slices.Contains(strings.Split(strip, "/"), "..") {
+			errs.add(&ConfigError{Field: "strip_prefix", Message: "must be a path relative to each source without \"..\": " + cfg.StripPrefix})
+		}
+	}
+
+	switch cfg.Mode {
+	case "", ModeUpload:
+	case ModeDownload:
+		if len(cfg.Sources) > 0 {
+			errs.add(&ConfigError{Field: "sources", Message: "cannot be used in download mode; set local_path instead"})
+		}
+		if cfg.Mirror || cfg.FileList != "" || cfg.StateFile != "" || cfg.DeleteAfterUpload || cfg.GenerateManifest {
+			errs.add(&ConfigError{Field: "mode", Message: "download cannot be combined with mirror, file_list, state_file, delete_after_upload or generate_manifest"})
+		}
+	case ModeMove:
+		errs.add(validateMove(cfg))
+	default:
+		errs.add(&ConfigError{Field: "mode", Message: fmt.Sprintf("must be %q, %q or %q: %q", ModeUpload, ModeDownload, ModeMove, cfg.Mode)})
+	}
+
+	if cfg.NoOverwrite && cfg.Mode != "" && cfg.Mode != ModeUpload {
+		errs.add(&ConfigError{Field: "no_overwrite", Message: "only applies in upload mode"})
+	}
+
+	switch cfg.SyncMode {
+	case "", SyncModeSize:
+	case SyncModeHash:
+		if !cfg.SkipExisting {
+			errs.add(&ConfigError{Field: "sync_mode", Message: "requires skip_existing to be set"})
+		}
+		if cfg.Mode != "" && cfg.Mode != ModeUpload {
+			errs.add(&ConfigError{Field: "sync_mode", Message: fmt.Sprintf("%q only applies in upload mode", SyncModeHash)})
+		}
+	default:
+		errs.add(&ConfigError{Field: "sync_mode", Message: fmt.Sprintf("must be %q or %q: %q", SyncModeSize, SyncModeHash, cfg.SyncMode)})
+	}
+
+	// CopyObject can't be made conditional, so copies could replace existing objects
+	if cfg.NoOverwrite && cfg.DedupByHash {
+		errs.add(&ConfigError{Field: "no_overwrite", Message: "cannot be combined with dedup_by_hash"})
+	}
+
+	errs.add(validateTargets(cfg))
+
+	if cfg.DeleteSource && cfg.Mode != ModeMove {
+		errs.add(&ConfigError{Field: "delete_source", Message: "only applies in move mode"})
+	}
+
+	if cfg.FileList != "" && cfg.Mirror {
+		errs.add(&ConfigError{Field: "file_list", Message: "cannot be combined with mirror, which would delete every object not in the list"})
+	}
+
+	if cfg.StateFile != "" && cfg.Mirror {
+		errs.add(&ConfigError{Field: "state_file", Message: "cannot be combined with mirror, which needs every file to be walked"})
+	}
+
+	if cfg.ManifestKey != "" && !cfg.GenerateManifest {
+		errs.add(&ConfigError{Field: "manifest_key", Message: "requires generate_manifest to be set"})
+	}
+
+	if cfg.Endpoint != "" && (cfg.UseDualStack || cfg.UseFIPS) {
+		errs.add(&ConfigError{Field: "endpoint", Message: "cannot be combined with use_dual_stack or use_fips, which pick an AWS endpoint"})
+	}
+
+	if cfg.UseAccelerate {
+		switch {
+		case cfg.Endpoint != "" || cfg.UseFIPS:
+			errs.add(&ConfigError{Field: "use_accelerate", Message: "cannot be combined with endpoint or use_fips"})
+		case cfg.UsePathStyle:
+			errs.add(&ConfigError{Field: "use_accelerate", Message: "cannot be combined with use_path_style"})
+		case strings.Contains(cfg.BucketName, "."):
+			errs.add(&ConfigError{Field: "use_accelerate", Message: "is not supported for bucket names containing dots"})
+		}
+	}
+
+	if cfg.HTTPProxy != "" {
+		if proxy, err := url.Parse(cfg.HTTPProxy); err != nil || proxy.Scheme == "" || proxy.Host == "" {
+			errs.add(&ConfigError{Field: "http_proxy", Message: "must be a URL such as \"http://proxy.example.com:3128\"", Err: err})
+		}
+	}
+
+	if cfg.CACertFile != "" {
+		if _, err := loadCACerts(cfg.CACertFile); err != nil {
+			errs.add(&ConfigError{Field: "ca_cert_file", Message: "could not be loaded", Err: err})
+		}
+	}
+
+	if cfg.OTLPEndpoint != "" {
+		if endpoint, err := url.Parse(cfg.OTLPEndpoint); err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			errs.add(&ConfigError{Field: "otlp_endpoint", Message: "must be an http or https URL such as \"http://localhost:4318\"", Err: err})
+		}
+	}
+
+	if cfg.MetricsAddr != "" {
+		if _, _, err := net.SplitHostPort(cfg.MetricsAddr); err != nil {
+			errs.add(&ConfigError{Field: "metrics_addr", Message: "must be a host:port address such as \":9090\"", Err: err})
+		}
+	}
+
+	if cfg.DeleteAfterUpload && cfg.Mirror {
+		errs.add(&ConfigError{Field: "delete_after_upload", Message: "cannot be combined with mirror, which would delete the uploaded objects on the next run"})
+	}
+
+	if cfg.Flatten && cfg.KeyTemplate != "" {
+		errs.add(&ConfigError{Field: "flatten", Message: "cannot be combined with key_template; use {{.Base}} in the template instead"})
+	}
+
+	// Mirror maps each remote key back to a local path by dropping the prefix, which only
+	// works for keys that mirror the tree; rewritten keys from earlier runs would be deleted
+	if cfg.KeyTemplate != "" && cfg.Mirror {
+		errs.add(&ConfigError{Field: "key_template", Message: "cannot be combined with mirror, which would delete the objects of earlier runs"})
+	}
+	if cfg.Flatten && cfg.Mirror {
+		errs.add(&ConfigError{Field: "flatten", Message: "cannot be combined with mirror, which would delete the objects of earlier runs"})
+	}
+	if cfg.LowercaseKeys && cfg.Mirror {
+		errs.add(&ConfigError{Field: "lowercase_keys", Message: "cannot be combined with mirror, which would delete the objects of earlier runs"})
+	}
+
+	if cfg.MaxDepth != nil && *cfg.MaxDepth < 0 {
+		errs.add(&ConfigError{Field: "max_depth", Message: fmt.Sprintf("must not be negative: %d", *cfg.MaxDepth)})
+	}
+
+	minSize, err := parseSizeField("min_size", cfg.MinSize)
+	errs.add(err)
+
+	maxSize, err := parseSizeField("max_size", cfg.MaxSize)
+	errs.add(err)
+
+	if maxSize > 0 && minSize > maxSize {
+		errs.add(&ConfigError{Field: "min_size", Message: fmt.Sprintf("must not be larger than max_size: %q > %q", cfg.MinSize, cfg.MaxSize)})
+	}
+
+	// Mirror only knows which keys pass the path filters, so the objects of files left
+	// out by size would be deleted as stale
+	if cfg.MinSize != "" && cfg.Mirror {
+		errs.add(&ConfigError{Field: "min_size", Message: "cannot be combined with mirror, which would delete the objects of smaller files"})
+	}
+	if cfg.MaxSize != "" && cfg.Mirror {
+		errs.add(&ConfigError{Field: "max_size", Message: "cannot be combined with mirror, which would delete the objects of larger files"})
+	}
+
+	now := time.Now()
+	modifiedAfter, err := parseTimeField("modified_after", cfg.ModifiedAfter, now)
+	errs.add(err)
+
+	modifiedBefore, err := parseTimeField("modified_before", cfg.ModifiedBefore, now)
+	errs.add(err)
+
+	// As with the size filters, mirror would delete the objects of files outside the window
+	if cfg.ModifiedAfter != "" && cfg.Mirror {
+		errs.add(&ConfigError{Field: "modified_after", Message: "cannot be combined with mirror, which would delete the objects of older files"})
+	}
+	if cfg.ModifiedBefore != "" && cfg.Mirror {
+		errs.add(&ConfigError{Field: "modified_before", Message: "cannot be combined with mirror, which would delete the objects of newer files"})
+	}
+
+	var limiter *rate.Limiter
+	if cfg.MaxBandwidth != "" {
+		bandwidth, err := parseByteSize(cfg.MaxBandwidth)
+		if err != nil || bandwidth <= 0 {
+			errs.add(&ConfigError{Field: "max_bandwidth", Message: fmt.Sprintf("must be a positive size such as \"5MB\": %q", cfg.MaxBandwidth)})
+		} else {
+			// Allow up to one second's worth of bytes in a single burst
+			limiter = rate.NewLimiter(rate.Limit(bandwidth), int(min(bandwidth, math.MaxInt32)))
+		}
+	}
+
+	expectedRate, err := parseSizeField("expected_throughput", cfg.ExpectedThroughput)
+	errs.add(err)
+	if expectedRate == 0 && limiter != nil {
+		expectedRate = int64(limiter.Limit())
+	}
+
+	var requests *requestLimiter
+	if cfg.MaxRequestsPerSecond < 0 {
+		errs.add(&ConfigError{Field: "max_requests_per_second", Message: "must not be negative"})
+	} else if cfg.MaxRequestsPerSecond > 0 {
+		requests = newRequestLimiter(cfg.MaxRequestsPerSecond)
+	}
+
+	switch cfg.LogFormat {
+	case "", logFormatJSON, logFormatConsole:
+	default:
+		errs.add(&ConfigError{Field: "log_format", Message: fmt.Sprintf("must be %q or %q: %q", logFormatJSON, logFormatConsole, cfg.LogFormat)})
+	}
+
+	if cfg.Endpoint != "" {
+		endpoint, err := url.Parse(cfg.Endpoint)
+		if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			errs.add(&ConfigError{Field: "endpoint", Message: fmt.Sprintf("must be an http or https URL: %q", cfg.Endpoint)})
+		}
+	}
+
+	for _, pattern := range append(append(cfg.IncludePatterns(), cfg.ExcludePatterns...), cfg.GzipPatterns...) {
+		if !doublestar.ValidatePattern(pattern) {
+			errs.add(&ConfigError{Field: "patterns", Message: fmt.Sprintf("contains an invalid pattern: %q", pattern)})
+		}
+	}
+
+	for _, rule := range cfg.HeaderRules {
+		if !doublestar.ValidatePattern(rule.Pattern) {
+			errs.add(&ConfigError{Field: "header_rules", Message: fmt.Sprintf("contains an invalid pattern: %q", rule.Pattern)})
+		}
+	}
+
+	if cfg.ACL != "" && !isValidACL(cfg.ACL) {
+		errs.add(&ConfigError{Field: "acl", Message: fmt.Sprintf("is not a known canned ACL: %q", cfg.ACL)})
+	}
+
+	switch types.ChecksumAlgorithm(cfg.ChecksumAlgorithm) {
+	case "", types.ChecksumAlgorithmCrc32, types.ChecksumAlgorithmCrc32c, types.ChecksumAlgorithmSha1, types.ChecksumAlgorithmSha256:
+	default:
+		errs.add(&ConfigError{Field: "checksum_algorithm", Message: fmt.Sprintf("must be CRC32, CRC32C, SHA1 or SHA256: %q", cfg.ChecksumAlgorithm)})
+	}
+
+	if cfg.StorageClass != "" && !isValidStorageClass(cfg.StorageClass) {
+		errs.add(&ConfigError{Field: "storage_class", Message: fmt.Sprintf("is not a known storage class: %q", cfg.StorageClass)})
+	}
+
+	for _, rule := range cfg.StorageClassRules {
+		if !doublestar.ValidatePattern(rule.Pattern) {
+			errs.add(&ConfigError{Field: "storage_class_rules", Message: fmt.Sprintf("contains an invalid pattern: %q", rule.Pattern)})
+		}
+		if !isValidStorageClass(rule.StorageClass) {
+			errs.add(&ConfigError{Field: "storage_class_rules", Message: fmt.Sprintf("contains an unknown storage class: %q", rule.StorageClass)})
+		}
+	}
+
+	if cfg.Tier != "" {
+		tierClass, ok := tierStorageClasses[cfg.Tier]
+		if !ok {
+			errs.add(&ConfigError{Field: "tier", Message: fmt.Sprintf("must be hot, warm, cold or archive: %q", cfg.Tier)})
+		} else if existing, ok := cfg.Tags[TierTagKey]; ok && existing != cfg.Tier {
+			errs.add(&ConfigError{Field: "tier", Message: fmt.Sprintf("conflicts with tag %s=%q", TierTagKey, existing)})
+		} else {
+			tags := make(map[string]string, len(cfg.Tags)+1)
+			for key, value := range cfg.Tags {
+				tags[key] = value
+			}
+			tags[TierTagKey] = cfg.Tier
+			cfg.Tags = tags
+
+			if cfg.TierStorageClass && cfg.StorageClass == "" {
+				cfg.StorageClass = string(tierClass)
+			}
+		}
+	} else if cfg.TierStorageClass {
+		errs.add(&ConfigError{Field: "tier_storage_class", Message: "requires tier to be set"})
+	}
+
+	switch types.ServerSideEncryption(cfg.ServerSideEncryption) {
+	case "", types.ServerSideEncryptionAes256, types.ServerSideEncryptionAwsKms:
+	default:
+		errs.add(&ConfigError{Field: "server_side_encryption", Message: fmt.Sprintf("must be %q or %q: %q",
+			types.ServerSideEncryptionAes256, types.ServerSideEncryptionAwsKms, cfg.ServerSideEncryption)})
+	}
+
+	if cfg.KMSKeyID != "" && types.ServerSideEncryption(cfg.ServerSideEncryption) != types.ServerSideEncryptionAwsKms {
+		errs.add(&ConfigError{Field: "kms_key_id", Message: fmt.Sprintf("requires server_side_encryption to be %q", types.ServerSideEncryptionAwsKms)})
+	}
+
+	var retainUntil time.Time
+	var retainFor time.Duration
+	switch types.ObjectLockMode(cfg.ObjectLockMode) {
+	case "":
+		if cfg.ObjectLockRetainUntil != "" {
+			errs.add(&ConfigError{Field: "object_lock_retain_until", Message: "requires object_lock_mode to be set"})
+		}
+	case types.ObjectLockModeGovernance, types.ObjectLockModeCompliance:
+		if t, err := time.Parse(time.RFC3339, cfg.ObjectLockRetainUntil); err == nil {
+			if !t.After(now) {
+				errs.add(&ConfigError{Field: "object_lock_retain_until", Message: fmt.Sprintf("must be in the future: %q", cfg.ObjectLockRetainUntil)})
+			}
+			retainUntil = t
+		} else if d, err := time.ParseDuration(cfg.ObjectLockRetainUntil); err == nil && d > 0 {
+			retainFor = d
+		} else {
+			errs.add(&ConfigError{Field: "object_lock_retain_until", Message: fmt.Sprintf("must be an RFC 3339 time or a positive duration such as \"8760h\": %q", cfg.ObjectLockRetainUntil)})
+		}
+	default:
+		errs.add(&ConfigError{Field: "object_lock_mode", Message: fmt.Sprintf("must be %q or %q: %q",
+			types.ObjectLockModeGovernance, types.ObjectLockModeCompliance, cfg.ObjectLockMode)})
+	}
+
+	var ignore *ignoreMatcher
+	if cfg.IgnoreFile != "" && len(sources) > 0 {
+		ignorePath := cfg.IgnoreFile
+		if !filepath.IsAbs(ignorePath) {
+			ignorePath = filepath.Join(sources[0].root, ignorePath)
+		}
+		if ignore, err = loadIgnoreFile(ignorePath); err != nil {
+			errs.add(&ConfigError{Field: "ignore_file", Message: "could not be loaded", Err: err})
+		}
+	}
+
+	var mimeMap map[string]string
+	if cfg.MimeMapFile != "" {
+		if mimeMap, err = loadMimeMap(cfg.MimeMapFile); err != nil {
+			errs.add(&ConfigError{Field: "mime_map_file", Message: "could not be loaded", Err: err})
+		}
+	}
+
+	var state *uploadState
+	if cfg.StateFile != "" {
+		if state, err = loadState(cfg.StateFile); err != nil {
+			errs.add(&ConfigError{Field: "state_file", Message: "could not be loaded", Err: err})
+		}
+	}
+
+	// Ensure region is set
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1" // Default region
+	} else if cfg.Endpoint == "" && !awsRegionPattern.MatchString(cfg.Region) {
+		// S3-compatible services are free to name their regions differently
+		errs.add(&ConfigError{Field: "region", Message: fmt.Sprintf("is not a valid AWS region such as \"us-east-1\": %q", cfg.Region)})
+	}
+
+	u := &Uploader{
+		config:         cfg,
+		retryBaseDelay: retryBaseDelay,
+		runRetryDelay:  runRetryDelay,
+		presignExpiry:  presignExpiry,
+		timeout:        timeout,
+		fileTimeout:    fileTimeout,
+		limiter:        limiter,
+		expectedRate:   expectedRate,
+		requests:       requests,
+		runID:          newRunID(),
+		startTime:      time.Now(),
+		keyTemplate:    keyTemplate,
+		minSize:        minSize,
+		maxSize:        maxSize,
+		modifiedAfter:  modifiedAfter,
+		modifiedBefore: modifiedBefore,
+		retainUntil:    retainUntil,
+		retainFor:      retainFor,
+		sources:        sources,
+		ignore:         ignore,
+		mimeMap:        mimeMap,
+		state:          state,
+		tracer:         noop.NewTracerProvider().Tracer(tracerName),
+	}
+	if cfg.GenerateManifest {
+		u.manifest = &manifest{}
+	}
+	if cfg.MetricsAddr != "" {
+		u.metrics = newMetrics(cfg.BucketName)
+	}
+	if cfg.DedupByHash {
+		u.dedup = &dedupIndex{entries: make(map[string]*dedupEntry)}
+	}
+
+	if err := u.validateTags(); err != nil {
+		errs.add(&ConfigError{Field: "tags", Message: "are invalid", Err: err})
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	// Create logger
+	if u.logger, err = createLogger(cfg.LogLevel, cfg.LogFormat, cfg.LogFile); err != nil {
+		return nil, fmt.Errorf("failed to create logger: %w", err)
+	}
+
+	if cfg.OTLPEndpoint != "" {
+		if u.tracerProvider, err = newTracerProvider(cfg.OTLPEndpoint); err != nil {
+			return nil, fmt.Errorf("failed to create trace exporter: %w", err)
+		}
+		u.tracer = u.tracerProvider.Tracer(tracerName)
+	}
+
+	return u, nil
+}
+
+// Validate checks cfg the same way NewUploader does, without creating an S3 client.
+// It returns ConfigErrors listing every problem found.
+func (c *Config) Validate() error {
+	_, err := newUploader(c)
+	return err
+}
+
+// parseDuration parses a duration field from the config, returning def when value is
+// empty or "0". Anything else must be a positive duration.
+func parseDuration(field, value string, def time.Duration) (time.Duration, error) {
+	if value == "" || value == "0" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, &ConfigError{Field: field, Message: fmt.Sprintf("must be a positive duration such as \"30s\" or \"2h\": %q", value)}
+	}
+	return d, nil
+}
+
+// parseSizeField parses an optional size field from the config; empty means zero
+func parseSizeField(field, value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	size, err := parseByteSize(value)
+	if err != nil {
+		return 0, &ConfigError{Field: field, Message: fmt.Sprintf("must be a size such as \"512KB\" or \"1MB\": %q", value)}
+	}
+	return size, nil
+}
+
+// parseTimeField parses an optional time field from the config. It accepts an RFC 3339
+// timestamp or a duration relative to now such as "-24h"; empty means the zero time.
+func parseTimeField(field, value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(d), nil
+	}
+	return time.Time{}, &ConfigError{Field: field, Message: fmt.Sprintf("must be an RFC 3339 time or a relative duration such as \"-24h\": %q", value)}
+}
+
+// isValidACL reports whether acl is one of the canned ACLs S3 accepts for objects
+func isValidACL(acl string) bool {
+	for _, known := range types.ObjectCannedACL("").Values() {
+		if string(known) == acl {
+			return true
+		}
+	}
+	return false
+}
+
+// isValidStorageClass reports whether class is one of the storage classes S3 accepts
+func isValidStorageClass(class string) bool {
+	for _, known := range types.StorageClass("").Values() {
+		if string(known) == class {
+			return true
+		}
+	}
+	return false
+}
+
+// Upload finds and uploads all matching files. If some files fail to upload
+// the returned error is an *UploadError.
+func (u *Uploader) Upload() error {
+	return u.UploadWithContext(context.Background())
+}
+
+// UploadWithContext is like Upload but stops when ctx is cancelled. Workers finish or
+// abort their current file, no new files are started, and a partial summary is logged.
+func (u *Uploader) UploadWithContext(ctx context.Context) error {
+	// The run span is the parent of every file's span
+	ctx, span := u.tracer.Start(ctx, "Upload", trace.WithAttributes(
+		attribute.String("s3.bucket", u.config.BucketName),
+		attribute.String("s3.prefix", u.config.S3Prefix),
+		attribute.String("run_id", u.runID)))
+	err := u.upload(ctx)
+	endSpan(span, err)
+	u.flushTraces()
+	return err
+}
+
+// upload runs UploadWithContext inside its span
+func (u *Uploader) upload(ctx context.Context) error {
+	// Create a context with timeout
+	ctx, cancel := context.WithTimeout(ctx, u.timeout)
+	defer cancel()
+
+	if u.config.EventLog != "" {
+		events, err := openEventLog(u.config.EventLog)
+		if err != nil {
+			return fmt.Errorf("failed to open event log: %w", err)
+		}
+		u.events = events
+		defer func() {
+			if err := events.close(); err != nil {
+				u.logger.Warn("Failed to close event log", zap.String("path", u.config.EventLog), zap.Error(err))
+			}
+			u.events = nil
+		}()
+	}
+
+	switch u.config.Mode {
+	case ModeDownload:
+		return u.download(ctx)
+	case ModeMove:
+		return u.move(ctx)
+	}
+
+	u.logger.Info("Starting upload",
+		zap.String("source", u.sources[0].localPath),
+		zap.Int("sources", len(u.sources)),
+		zap.String("bucket", u.config.BucketName),
+		zap.String("prefix", u.config.S3Prefix),
+		zap.String("region", u.config.Region),
+		zap.String("run_id", u.runID))
+
+	if u.config.InsecureSkipVerify {
+		u.logger.Warn("TLS certificate verification is DISABLED; connections can be intercepted. Never use insecure_skip_verify in production",
+			zap.String("endpoint", u.config.Endpoint))
+	}
+
+	switch types.ObjectCannedACL(u.config.ACL) {
+	case types.ObjectCannedACLPublicRead, types.ObjectCannedACLPublicReadWrite:
+		u.logger.Warn("Uploaded objects will be PUBLICLY readable by anyone on the internet",
+			zap.String("acl", u.config.ACL),
+			zap.String("bucket", u.config.BucketName),
+			zap.String("prefix", u.config.S3Prefix))
+	}
+
+	// Fail fast on a wrong bucket, region or credentials rather than once per file
+	if !u.config.DryRun {
+		if err := u.checkBucket(ctx); err != nil {
+			return err
+		}
+		if u.config.UseAccelerate {
+			u.checkAccelerate(ctx)
+		}
+		if u.config.ObjectLockMode != "" {
+			u.checkObjectLock(ctx)
+		}
+		if err := u.prepareReplicas(ctx); err != nil {
+			return err
+		}
+	}
+
+	// List the prefix once up front rather than calling HeadObject for every file
+	if u.config.SkipExisting && !u.config.DryRun {
+		existing, err := u.listExisting(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list existing objects: %w", err)
+		}
+		u.existing = existing
+		u.logger.Info("Listed existing objects", zap.Int("count", len(existing)))
+	}
+
+	// Refuse to start if two files would be written to the same key, sort the files for
+	// UploadOrder, and log the totals first for ScanFirst. These need every file up front,
+	// so in these cases discovery doesn't overlap with uploading.
+	var collected []LocalFile
+	checkCollisions := u.config.Flatten || u.keyTemplate != nil || u.config.LowercaseKeys || u.config.SanitizeKeys || len(u.sources) > 1
+	sortFiles := u.config.UploadOrder != "" && u.config.UploadOrder != UploadOrderNone
+	preWalk := checkCollisions || sortFiles || u.config.ScanFirst
+	if preWalk {
+		var err error
+		if collected, err = u.collectFiles(ctx); err != nil {
+			return fmt.Errorf("failed to find files: %w", err)
+		}
+		var size int64
+		for _, file := range collected {
+			size += file.Size
+		}
+		u.logFound(nil, len(collected), size)
+		if checkCollisions {
+			if err := u.checkKeyCollisions(collected); err != nil {
+				return err
+			}
+		}
+		if sortFiles {
+			sortUploadOrder(collected, u.config.UploadOrder)
+		}
+	}
+
+	prog := u.startProgress()
+	start := time.Now()
+
+	// Feed workers while the walk is still running so uploads start with the first file
+	// found. Only counts are kept, plus the keys Mirror needs, so memory doesn't grow with
+	// the number of files.
+	var totalFiles int
+	var totalSize int64
+	var localKeys map[string]struct{}
+	if u.config.Mirror {
+		localKeys = make(map[string]struct{})
+	}
+	var stats runStats
+	walkErr := u.runPass(ctx, prog, &stats, func(send func(LocalFile) error) error {
+		found := func(file LocalFile) error {
+			if localKeys != nil {
+				s3Key, err := u.s3Key(file.Path)
+				if err != nil {
+					return err
+				}
+				localKeys[s3Key] = struct{}{}
+			}
+			totalFiles++
+			totalSize += file.Size
+			prog.addTotal(file.Size)
+			return send(file)
+		}
+
+		var err error
+		if preWalk {
+			for _, file := range collected {
+				if err = found(file); err != nil {
+					break
+				}
+			}
+			// Let the list be garbage collected while the uploads finish
+			collected = nil
+		} else {
+			err = u.findFiles(ctx, found)
+		}
+		if err == nil && !preWalk {
+			u.logFound(prog, totalFiles, totalSize)
+		}
+		return err
+	})
+
+	// Give files that failed more chances, e.g. to ride out a network outage
+	if walkErr == nil {
+		u.retryFailed(ctx, prog, &stats)
+	}
+
+	// Save the final progress, including when interrupted, so the next run resumes from here
+	if u.state != nil {
+		if err := u.state.flush(); err != nil {
+			u.logger.Error("Failed to save state file", zap.String("path", u.config.StateFile), zap.Error(err))
+		}
+	}
+
+	prog.finish()
+
+	if walkErr != nil && ctx.Err() == nil {
+		return fmt.Errorf("failed to find files: %w", walkErr)
+	}
+
+	processedFiles, succeededFiles, skippedFiles := stats.processed, stats.succeeded, stats.skipped
+	failures, urls, durations := stats.failures, stats.urls, &stats.durations
+	sort.Slice(failures, func(i, j int) bool { return failures[i].Path < failures[j].Path })
+	sort.Slice(urls, func(i, j int) bool { return urls[i].Path < urls[j].Path })
+
+	unreadable := u.unreadablePaths()
+	if len(unreadable) > 0 {
+		u.logger.Warn("Skipped unreadable paths",
+			zap.Int("count", len(unreadable)),
+			zap.Strings("paths", unreadable))
+	}
+
+	if totalFiles == 0 {
+		u.logger.Info("No files to upload")
+		// Every object under the prefix is stale once the source is empty
+		if u.config.Mirror && ctx.Err() == nil {
+			if err := u.deleteStale(ctx, localKeys); err != nil {
+				return fmt.Errorf("failed to delete stale objects: %w", err)
+			}
+		}
+		return nil
+	}
+
+	elapsed := time.Since(start)
+	totalBytes := atomic.LoadInt64(&u.bytesUploaded)
+
+	if u.config.DryRun {
+		u.logger.Info("Dry run completed",
+			zap.Int("total_files", succeededFiles),
+			zap.Int64("total_bytes", totalBytes),
+			zap.String("bucket", u.config.BucketName),
+			zap.String("prefix", u.config.S3Prefix))
+	} else {
+		sorted := durations.sorted()
+		u.logger.Info("Transfer statistics",
+			zap.Int64("total_bytes", totalBytes),
+			zap.Duration("duration", elapsed),
+			zap.Float64("throughput_mb_per_sec", throughputMBps(totalBytes, elapsed)),
+			zap.Duration("p50_file_duration", percentile(sorted, 50)),
+			zap.Duration("p95_file_duration", percentile(sorted, 95)))
+	}
+
+	for _, target := range u.targetReports() {
+		u.logger.Info("Bucket results",
+			zap.String("bucket", target.Bucket),
+			zap.String("prefix", target.Prefix),
+			zap.Int64("succeeded_files", target.SucceededFiles),
+			zap.Int64("skipped_files", target.SkippedFiles),
+			zap.Int64("failed_files", target.FailedFiles))
+	}
+
+	var reportErr error
+	if u.config.ReportPath != "" {
+		report := &Report{
+			RunID:           u.runID,
+			Bucket:          u.config.BucketName,
+			Prefix:          u.config.S3Prefix,
+			StartTime:       start.UTC(),
+			EndTime:         start.Add(elapsed).UTC(),
+			DryRun:          u.config.DryRun,
+			Interrupted:     ctx.Err() != nil,
+			TotalFiles:      totalFiles,
+			SucceededFiles:  succeededFiles,
+			SkippedFiles:    skippedFiles,
+			ExistingFiles:   stats.existing,
+			DeletedFiles:    int(atomic.LoadInt64(&u.localFilesDeleted)),
+			FailedFiles:     len(failures),
+			TotalBytes:      totalBytes,
+			DurationSeconds: elapsed.Seconds(),
+			ThroughputMBps:  throughputMBps(totalBytes, elapsed),
+			Failures:        []ReportFailure{},
+			PresignedURLs:   urls,
+			Targets:         u.targetReports(),
+			UnreadablePaths: unreadable,
+		}
+		for _, failure := range failures {
+			report.Failures = append(report.Failures, ReportFailure{Path: failure.Path, Error: failure.Err.Error()})
+		}
+		// A missing report shouldn't hide the upload result, so it is only returned on success
+		if reportErr = writeReport(u.config.ReportPath, report); reportErr != nil {
+			u.logger.Error("Failed to write report", zap.String("path", u.config.ReportPath), zap.Error(reportErr))
+		}
+	}
+
+	if ctx.Err() != nil {
+		if u.config.Mirror {
+			u.logger.Warn("Skipping mirror deletes because the upload was interrupted")
+		}
+		u.logger.Warn("Upload interrupted",
+			zap.Int("uploaded_files", succeededFiles),
+			zap.Int("skipped_files", skippedFiles),
+			zap.Int("existing_files", stats.existing),
+			zap.Int("failed_files", len(failures)),
+			zap.Int("remaining_files", totalFiles-processedFiles))
+		return fmt.Errorf("upload interrupted after %d of %d files: %w", processedFiles, totalFiles, ctx.Err())
+	}
+
+	if len(failures) > 0 {
+		if u.config.Mirror {
+			u.logger.Warn("Skipping mirror deletes because some uploads failed")
+		}
+		u.logger.Warn("Upload completed with errors", zap.Int("failed_files", len(failures)))
+		return &UploadError{Failed: len(failures), Total: totalFiles, Failures: failures}
+	}
+
+	if reportErr != nil {
+		return reportErr
+	}
+
+	if u.config.GenerateManifest {
+		if err := u.uploadManifest(ctx); err != nil {
+			return err
+		}
+	}
+
+	if u.config.Mirror {
+		if err := u.deleteStale(ctx, localKeys); err != nil {
+			return fmt.Errorf("failed to delete stale objects: %w", err)
+		}
+	}
+
+	u.logger.Info("Upload completed successfully",
+		zap.Int("total_files", totalFiles),
+		zap.Int("skipped_files", skippedFiles),
+		zap.Int("existing_files", stats.existing),
+		zap.Int64("deleted_local_files", atomic.LoadInt64(&u.localFilesDeleted)))
+	return nil
+}
+
+// logFound logs the number and total size of the files to upload, with an estimate of
+// how long they will take. While uploading, prog gives the throughput measured so far.
+func (u *Uploader) logFound(prog *progress, count int, size int64) {
+	fields := []zap.Field{
+		zap.Int("count", count),
+		zap.Int64("total_bytes", size),
+		zap.String("total_size", formatBytes(size)),
+	}
+	if eta, ok := prog.eta(size, u.expectedRate); ok {
+		fields = append(fields, zap.Duration("estimated_duration", eta.Round(time.Second)))
+	}
+	u.logger.Info("Found files to upload", fields...)
+}
+
+// retryFailed gives the files that failed in stats up to RunRetries more passes
+func (u *Uploader) retryFailed(ctx context.Context, prog *progress, stats *runStats) {
+	for round := 1; round <= u.config.RunRetries && len(stats.failed) > 0 && ctx.Err() == nil; round++ {
+		retry := stats.failed
+		u.logger.Warn("Retrying failed files",
+			zap.Int("round", round),
+			zap.Int("max_rounds", u.config.RunRetries),
+			zap.Int("remaining_files", len(retry)),
+			zap.Duration("delay", u.runRetryDelay))
+
+		select {
+		case <-time.After(u.runRetryDelay):
+		case <-ctx.Done():
+			continue
+		}
+
+		// The retried files are processed again, so they no longer count as failed
+		stats.processed -= len(retry)
+		stats.failures, stats.failed = nil, nil
+		prog.retrying(len(retry))
+		u.runPass(ctx, prog, stats, func(send func(LocalFile) error) error {
+			for _, file := range retry {
+				if err := send(file); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+}
+
+// runStats accumulates file results across the passes of a run
+type runStats struct {
+	processed, succeeded, skipped int
+	existing                      int // Skipped files S3 refused to overwrite with NoOverwrite
+	failures                      []FileFailure
+	failed                        []LocalFile // The files behind failures, for another pass
+	urls                          []PresignedURL
+	durations                     durationSample
+}
+
+// runPass uploads the files that feed passes to send with a fresh worker pool and adds
+// the results to stats. It returns feed's error once every worker is done.
+func (u *Uploader) runPass(ctx context.Context, prog *progress, stats *runStats, feed func(send func(LocalFile) error) error) error {
+	var wg sync.WaitGroup
+	jobs := make(chan LocalFile, u.config.MaxConcurrency)
+	results := make(chan fileResult, u.config.MaxConcurrency)
+
+	// In adaptive mode all workers are started but a gate limits how many upload at once
+	var gate *concurrencyGate
+	tuneDone := make(chan struct{})
+	if u.config.AdaptiveConcurrency {
+		limit := min(adaptiveInitialWorkers, u.config.MaxConcurrency)
+		gate = newConcurrencyGate(limit)
+		u.logger.Info("Adaptive concurrency enabled",
+			zap.Int("initial_workers", limit),
+			zap.Int("max_workers", u.config.MaxConcurrency))
+		go u.tuneConcurrency(ctx, gate, limit, tuneDone)
+	}
+
+	// Start workers
+	for i := 0; i < u.config.MaxConcurrency; i++ {
+		wg.Add(1)
+		go u.uploadWorker(ctx, &wg, jobs, results, prog, gate)
+	}
+
+	feedErr := make(chan error, 1)
+	go func() {
+		defer close(jobs)
+		feedErr <- feed(func(file LocalFile) error {
+			select {
+			case jobs <- file:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+
+	// Close results once every worker is done so the loop below ends
+	go func() {
+		wg.Wait()
+		close(tuneDone)
+		close(results)
+	}()
+
+	for result := range results {
+		switch {
+		case ctx.Err() != nil && errors.Is(result.Err, ctx.Err()):
+			// Cut short by cancellation; counted as remaining below
+			continue
+		case errors.Is(result.Err, ErrObjectExists):
+			stats.skipped++
+			stats.existing++
+		case errors.Is(result.Err, ErrSkipped):
+			stats.skipped++
+		case result.Err != nil:
+			stats.failures = append(stats.failures, FileFailure{Path: result.File.Path, Err: result.Err})
+			stats.failed = append(stats.failed, result.File)
+		default:
+			stats.succeeded++
+			stats.durations.add(result.Duration)
+			if result.URL != nil {
+				stats.urls = append(stats.urls, *result.URL)
+			}
+		}
+		stats.processed++
+	}
+
+	return <-feedErr
+}
+
+// uploadWorker handles file uploads
+func (u *Uploader) uploadWorker(ctx context.Context, wg *sync.WaitGroup, jobs <-chan LocalFile, results chan<- fileResult, prog *progress, gate *concurrencyGate) {
+	defer wg.Done()
+
+	for job := range jobs {
+		// Stop pulling new work once the upload is cancelled
+		if ctx.Err() != nil {
+			return
+		}
+
+		if gate != nil && !gate.acquire() {
+			return
+		}
+
+		filePath := job.Path
+		start := time.Now()
+		u.metrics.startFile()
+		fileProg := prog.startFile(job.Size)
+		var size int64
+		var etag string
+		var err error
+		switch {
+		case u.config.Mode == ModeMove:
+			size, etag, err = u.moveObject(ctx, job)
+		case job.Key != "":
+			size, etag, err = u.downloadObject(ctx, job)
+		case job.Dir:
+			err = u.replicate(ctx, job, func() error {
+				return u.uploadFolderMarker(ctx, filePath)
+			})
+		default:
+			err = u.replicate(ctx, job, func() error {
+				var err error
+				size, etag, err = u.uploadFile(withFileProgress(ctx, fileProg), filePath)
+				return err
+			})
+		}
+		duration := time.Since(start)
+		u.metrics.finishFile(size, err)
+		u.logEvent(ctx, job, size, etag, duration, err)
+
+		if gate != nil {
+			gate.release()
+		}
+		result := fileResult{File: job, Size: size, Duration: duration, Err: err}
+
+		switch {
+		case errors.Is(err, ErrSkipped):
+			// Already logged by uploadFile
+		case err != nil && job.Key != "":
+			u.logger.Error("Transfer failed",
+				zap.String("mode", u.config.Mode),
+				zap.String("s3_key", job.Key),
+				zap.String("destination", filePath),
+				zap.Error(err))
+		case err != nil:
+			u.logger.Error("Upload failed",
+				zap.String("file", filePath),
+				zap.Error(err))
+		default:
+			atomic.AddInt64(&u.bytesUploaded, size)
+			// Downloads and moves have nothing more to do
+			if job.Key != "" {
+				u.logger.Debug("Object transferred",
+					zap.String("mode", u.config.Mode),
+					zap.String("s3_key", job.Key),
+					zap.String("destination", filePath),
+					zap.Int64("size", size),
+					zap.Duration("duration", duration))
+				break
+			}
+
+			// Determine S3 key for logging
+			s3Key, _ := u.s3Key(filePath)
+
+			u.logger.Debug("File uploaded",
+				zap.String("file", filePath),
+				zap.String("s3_key", s3Key),
+				zap.Int64("size", size),
+				zap.Duration("duration", duration),
+				zap.Float64("throughput_mb_per_sec", throughputMBps(size, duration)))
+
+			if u.config.GeneratePresignedURLs && !u.config.DryRun && !job.Dir {
+				if link, err := u.presignURL(ctx, s3Key); err != nil {
+					u.logger.Warn("Failed to generate presigned URL", zap.String("s3_key", s3Key), zap.Error(err))
+				} else {
+					result.URL = &PresignedURL{Path: filePath, Key: s3Key, URL: link}
+					u.logger.Info("Presigned URL", zap.String("s3_key", s3Key), zap.String("url", link))
+				}
+			}
+
+			if u.state != nil && !u.config.DryRun && !job.Dir {
+				if err := u.state.record(s3Key, job.Size, job.ModTime); err != nil {
+					u.logger.Warn("Failed to save state file", zap.String("path", u.config.StateFile), zap.Error(err))
+				}
+			}
+
+			if u.config.DeleteAfterUpload && !u.config.DryRun && !job.Dir {
+				u.deleteLocalFile(filePath)
+			}
+		}
+		results <- result
+
+		// Settle at the size found during the walk so the bar ends at its total when nothing failed
+		prog.add(fileProg, err)
+	}
+}
+
+// logEvent appends the outcome of a job to EventLog. Files cut short by cancellation
+// aren't finished, so they get no line.
+func (u *Uploader) logEvent(ctx context.Context, job LocalFile, size int64, etag string, duration time.Duration, err error) {
+	if u.events == nil || (ctx.Err() != nil && errors.Is(err, ctx.Err())) {
+		return
+	}
+	event := Event{
+		Time:            time.Now().UTC(),
+		RunID:           u.runID,
+		Path:            job.Path,
+		Key:             job.Key,
+		Size:            size,
+		ETag:            etag,
+		DurationSeconds: duration.Seconds(),
+		Status:          eventStatus(err),
+	}
+	switch {
+	case u.config.Mode == ModeMove:
+		// The job's Path is the destination key
+		event.Path, event.SourceKey, event.Key = "", job.Key, job.Path
+	case job.Dir:
+		if key, err := u.baseKey(job.Path); err == nil {
+			event.Key = key + "/"
+		}
+	case job.Key == "":
+		event.Key, _ = u.s3Key(job.Path)
+	}
+	if event.Status == EventFailed {
+		event.Error = err.Error()
+	}
+	if err := u.events.write(event); err != nil {
+		u.logger.Warn("Failed to write event log", zap.String("path", u.config.EventLog), zap.Error(err))
+	}
+}
+
+// deleteLocalFile removes a file that has been uploaded. A failure is only logged
+// since the upload itself succeeded.
+func (u *Uploader) deleteLocalFile(filePath string) {
+	if err := os.Remove(filePath); err != nil {
+		u.logger.Warn("Failed to delete local file after upload",
+			zap.String("file", filePath),
+			zap.Error(err))
+		return
+	}
+	atomic.AddInt64(&u.localFilesDeleted, 1)
+	u.logger.Debug("Deleted local file after upload", zap.String("file", filePath))
+}
@@ -0,0 +1,57 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestNewUploaderRejectsMirrorWithFilters(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		field     string
+		configure func(*Config)
+	}{
+		{"min_size", func(cfg *Config) { cfg.MinSize = "1MB" }},
+		{"max_size", func(cfg *Config) { cfg.MaxSize = "1MB" }},
+		{"modified_after", func(cfg *Config) { cfg.ModifiedAfter = "-24h" }},
+		{"modified_before", func(cfg *Config) { cfg.ModifiedBefore = "-24h" }},
+		{"key_template", func(cfg *Config) { cfg.KeyTemplate = "{{.Date}}/{{.RelPath}}" }},
+		{"flatten", func(cfg *Config) { cfg.Flatten = true }},
+		{"lowercase_keys", func(cfg *Config) { cfg.LowercaseKeys = true }},
+	}
+	for _, test := range tests {
+		cfg := &Config{BucketName: "test-bucket", Region: "us-east-1", LocalPath: dir, LogLevel: "error", Mirror: true}
+		test.configure(cfg)
+		_, err := NewUploaderWithClient(cfg, newFakeS3())
+
+		var configErr *ConfigError
+		if !errors.As(err, &configErr) {
+			t.Errorf("%s with mirror: got %v, want a ConfigError", test.field, err)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.field+" cannot be combined with mirror") {
+			t.Errorf("%s with mirror: got %q", test.field, err)
+		}
+	}
+}
+
+func TestUploadWarnsOnLowercaseCollisions(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "Report.csv", 100)
+	writeTestFile(t, dir, "report.csv", 200)
+	u, client := newTestUploader(t, dir, func(cfg *Config) {
+		cfg.LowercaseKeys = true
+	})
+
+	if err := u.UploadWithContext(context.Background()); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if n := client.callCount("PutObject"); n != 2 {
+		t.Errorf("PutObject was called %d times, want 2", n)
+	}
+	if _, ok := client.object("backup/report.csv"); !ok {
+		t.Error("object backup/report.csv was not stored")
+	}
+}